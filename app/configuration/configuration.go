@@ -1,63 +1,387 @@
 package configuration
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"runtime"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/speedtest-monitor/app/resolver"
+	"github.com/speedtest-monitor/app/speedtest"
 )
 
 // Configuration represents the config variables to be loaded from a
-// configuration.json file
+// configuration file, in JSON, YAML or TOML format. The json tags are the
+// keys in the file; each key can also be overridden with a flag and an
+// environment variable, see Keys.
+// Secret values can be given as `file:<path>` or `env:<name>`, to be read
+// from a file or an environment variable when the configuration is loaded.
 type Configuration struct {
-	AppName           string
-	DownloadThreshold float64
-	Interval          int
-	LoggingLevel      string
-	UploadThreshold   float64
-	ServerMode        bool
-	SlackEndpoint     string
+	AppName           string   `json:"appName" help:"Name to identify this service"`
+	ServerMode        bool     `json:"serverMode" help:"Serve when no command is given (deprecated, use the serve command)"`
+	Interval          int      `json:"interval" patch:"true" help:"Seconds between each poll in server mode"`
+	LoggingLevel      string   `json:"loggingLevel" help:"Logging level (debug, info, warning, error)"`
+	SlackEndpoint     string   `json:"slackEndpoint" secret:"true" help:"Slack webhook URL for messages and alerts"`
+	DownloadThreshold float64  `json:"downloadThreshold" patch:"true" help:"Alert when the download speed is lower (Mbit/s)"`
+	UploadThreshold   float64  `json:"uploadThreshold" patch:"true" help:"Alert when the upload speed is lower (Mbit/s)"`
+	LatencyThreshold  float64  `json:"latencyThreshold" patch:"true" help:"Alert when the ping is higher (ms), disabled if 0"`
+	DNSThreshold      float64  `json:"dnsThreshold" patch:"true" help:"Alert when the DNS lookup of the server takes longer (ms), disabled if 0"`
+	ConnectThreshold  float64  `json:"connectThreshold" patch:"true" help:"Alert when the TCP connection to the server takes longer (ms), disabled if 0"`
+	TLSThreshold      float64  `json:"tlsThreshold" patch:"true" help:"Alert when the TLS handshake with the server takes longer (ms), disabled if 0"`
+	TTFBThreshold     float64  `json:"ttfbThreshold" patch:"true" help:"Alert when the first byte of the server takes longer (ms), disabled if 0"`
+	Latitude          *float64 `json:"latitude" flag:"lat" help:"Fixed latitude used to find the nearest servers"`
+	Longitude         *float64 `json:"longitude" flag:"lon" help:"Fixed longitude used to find the nearest servers"`
+	City              string   `json:"city" help:"City whose coordinates are used to find the nearest servers"`
+	Backend           string   `json:"backend" help:"Backend providing the servers and the protocol of the tests (speedtest, librespeed, iperf3, http)"`
+	SpeedtestServers  []string `json:"speedtestServers" patch:"true" help:"Comma separated URLs of self-hosted servers tested by the speedtest backend instead of the speedtest.net ones"`
+	LibreSpeedServers string   `json:"libreSpeedServers" help:"URL or path of the JSON list of servers of the librespeed backend"`
+	Iperf3Servers     []string `json:"iperf3Servers" patch:"true" help:"Comma separated host[:port] of the servers of the iperf3 backend"`
+	HTTPDownloadURL   string   `json:"httpDownloadUrl" patch:"true" help:"URL of the downloads of the http backend, {bytes} is replaced with the size requested"`
+	HTTPUploadURL     string   `json:"httpUploadUrl" patch:"true" help:"URL where the http backend POSTs the uploads"`
+	HTTPPingURL       string   `json:"httpPingUrl" patch:"true" help:"URL of a small endpoint where the http backend measures the latency, the download URL for 0 bytes if empty"`
+	HTTPPingMethod    string   `json:"httpPingMethod" help:"Method of the latency requests of the http backend (HEAD, GET)"`
+	Servers           []int    `json:"servers" patch:"true" help:"Comma separated IDs of the servers to test, the nearest one if empty"`
+	Strategy          string   `json:"strategy" help:"Strategy to pick the servers tested on each poll (all, round-robin, random, primary)"`
+	SampleSize        int      `json:"sampleSize" help:"Number of servers tested on each poll by the random strategy"`
+	SecondaryEvery    int      `json:"secondaryEvery" help:"Polls between each secondary server test of the primary strategy"`
+	Aggregate         string   `json:"aggregate" help:"Function to combine the results of multiple servers (mean, median, max)"`
+	HistorySize       int      `json:"historySize" help:"Number of results kept in memory"`
+	HistoryFile       string   `json:"historyFile" help:"File where every result is stored, one JSON result per line"`
+	Resolvers         []string `json:"resolvers" help:"Comma separated DNS resolvers probed in server mode: system, or IPs with an optional port"`
+	ResolverHosts     []string `json:"resolverHosts" help:"Comma separated hostnames resolved by the DNS resolver probes, which are disabled if empty"`
+	ResolverInterval  int      `json:"resolverInterval" help:"Seconds between each DNS resolver probe"`
+	ResolverThreshold float64  `json:"resolverThreshold" patch:"true" help:"Alert when a DNS resolver takes longer to answer (ms), disabled if 0"`
+	ResolverChanges   bool     `json:"resolverChanges" help:"Alert when the answer of a DNS resolver changes"`
+	ResolverFile      string   `json:"resolverFile" help:"File where every DNS resolver probe is stored, one JSON probe per line"`
+	MaxSpeedRatio     float64  `json:"maxSpeedRatio" help:"Flag results whose download and upload speeds differ by more than this ratio"`
+	MaxSpeedFactor    float64  `json:"maxSpeedFactor" help:"Flag results faster than this factor of the usual speed"`
+	RetrySuspect      bool     `json:"retrySuspect" help:"Retry suspect results against another server"`
+	APIToken          string   `json:"apiToken" secret:"true" help:"Bearer token required by the configuration API, which is disabled if empty"`
+	PersistConfig     bool     `json:"persistConfig" help:"Write the changes made through the configuration API back to the config file"`
+
+	path       string
+	references map[string]string
+	overridden map[string]bool
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Source   string
+	Problems []string
 }
 
-// LoadConfiguration loads the json config file into a Configuration struct
-func LoadConfiguration() *Configuration {
-	_, filename, _, ok := runtime.Caller(2)
-	if !ok {
-		log.Error("No caller information")
-		return nil
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration in %s:\n  - %s", e.Source, strings.Join(e.Problems, "\n  - "))
+}
+
+// Defaults returns the configuration used for the keys missing in the
+// configuration file
+func Defaults() *Configuration {
+	return &Configuration{
+		AppName:           "speedtest-monitor",
+		Interval:          1800,
+		LoggingLevel:      "info",
+		Backend:           speedtest.BackendSpeedtest,
+		LibreSpeedServers: speedtest.LibreSpeedServerList,
+		HTTPPingMethod:    "HEAD",
+		Strategy:          speedtest.StrategyAll,
+		SampleSize:        1,
+		SecondaryEvery:    4,
+		Aggregate:         speedtest.AggregateMean,
+		HistorySize:       100,
+		Resolvers:         []string{resolver.System},
+		ResolverInterval:  60,
+		MaxSpeedRatio:     100,
+		MaxSpeedFactor:    10,
 	}
-	log.Debug(filename)
+}
 
-	filePath := "./app/configuration/configuration.json"
+// SearchPaths returns the paths where the configuration file is looked
+// for when none is given, in order. Each directory is searched for a
+// configuration.json, configuration.yaml, configuration.yml and
+// configuration.toml file.
+func SearchPaths() []string {
+	dirs := []string{"./app/configuration"}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		dirs = append(dirs, filepath.Join(configHome, "speedtest-monitor"))
+	}
+	dirs = append(dirs, "/etc/speedtest-monitor", "/run/config")
 
-	if _, err := os.Stat(filePath); err != nil {
-		log.Errorf("Error while reading JSON config file: %s. Trying with absolute path", err)
-		filePath = "/run/config/configuration.json"
-		if _, err := os.Stat(filePath); err != nil {
-			log.Errorf("Error while reading JSON config file: %s", err)
-			panic(fmt.Sprintf("Error while reading JSON config file: %s", err))
+	paths := []string{}
+	for _, dir := range dirs {
+		for _, name := range fileNames {
+			paths = append(paths, filepath.Join(dir, name))
 		}
 	}
+	return paths
+}
+
+// LoadConfiguration loads the config file into a Configuration struct. If
+// filePath is empty, the first file found in SearchPaths is loaded, or the
+// defaults are used if there is none.
+func LoadConfiguration(filePath string) (*Configuration, error) {
+	if filePath != "" {
+		return Load(filePath)
+	}
 
-	jFile, _ := ioutil.ReadFile(filePath)
-	var data map[string]interface{}
-	err := json.Unmarshal(jFile, &data)
+	for _, path := range SearchPaths() {
+		if _, err := os.Stat(path); err == nil {
+			return Load(path)
+		}
+		log.Debugf("No config file in %s", path)
+	}
+	log.Info("No config file found, using the default configuration")
+	return Defaults(), nil
+}
+
+// Load reads and validates a configuration file. Missing keys take their
+// default value.
+func Load(filePath string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading config file: %s", err)
+	}
+	conf, err := Parse(data, filePath)
+	if err != nil {
+		return nil, err
+	}
+	conf.path = filePath
+	log.Debugf("Loaded config file %s", filePath)
+	return conf, nil
+}
+
+// Path returns the file the configuration was loaded from, or an empty
+// string if it only has the defaults
+func (c *Configuration) Path() string {
+	return c.path
+}
 
+// Parse decodes and validates a configuration, in the format given by the
+// extension of source. Every problem found, from unknown keys to values out
+// of range, is reported in a single ValidationError.
+func Parse(data []byte, source string) (*Configuration, error) {
+	values, err := decodeValues(data, FormatOf(source))
 	if err != nil {
-		log.Errorf("Error while reading JSON config file: %s", err)
-		panic(fmt.Sprintf("Error while reading JSON config file: %s", err))
-	}
-
-	conf := &Configuration{}
-	conf.AppName = fmt.Sprintf("%v", data["appName"])
-	conf.LoggingLevel = fmt.Sprintf("%v", data["loggingLevel"])
-	conf.DownloadThreshold = data["downloadThreshold"].(float64)
-	conf.Interval = int(data["interval"].(float64))
-	conf.UploadThreshold = data["uploadThreshold"].(float64)
-	conf.ServerMode = data["serverMode"].(bool)
-	conf.SlackEndpoint = fmt.Sprintf("%v", data["slackEndpoint"])
-	return conf
+		return nil, &ValidationError{Source: source, Problems: []string{err.Error()}}
+	}
+
+	conf := Defaults()
+	problems := conf.decode(values)
+	problems = append(problems, conf.resolveSecrets()...)
+	problems = append(problems, conf.validate()...)
+	if conf.PersistConfig && FormatOf(source) == FormatTOML {
+		problems = append(problems, "persistConfig: not supported with TOML files, which would lose their comments, use a JSON or YAML file")
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Source: source, Problems: problems}
+	}
+	return conf, nil
+}
+
+// Validate checks the values of the configuration
+func (c *Configuration) Validate() error {
+	if problems := c.validate(); len(problems) > 0 {
+		return &ValidationError{Source: "configuration", Problems: problems}
+	}
+	return nil
+}
+
+// fields maps each configuration key to its struct field
+func (c *Configuration) fields() map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if key != "" {
+			fields[key] = v.Field(i)
+		}
+	}
+	return fields
+}
+
+// decode sets the fields from the raw values, returning the unknown keys
+// and the values of the wrong type
+func (c *Configuration) decode(values map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := []string{}
+	fields := c.fields()
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown key %q", key))
+			continue
+		}
+		if bytes.Equal(bytes.TrimSpace(values[key]), []byte("null")) {
+			continue
+		}
+		if err := json.Unmarshal(values[key], field.Addr().Interface()); err != nil {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				problems = append(problems, fmt.Sprintf("%s: expected %s, got %s", key, typeErr.Type, typeErr.Value))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+			}
+		}
+	}
+	return problems
+}
+
+// validate checks the range of every value
+func (c *Configuration) validate() []string {
+	problems := []string{}
+	if c.Interval <= 0 {
+		problems = append(problems, fmt.Sprintf("interval: must be a positive number of seconds, got %d", c.Interval))
+	}
+	if _, err := log.ParseLevel(c.LoggingLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("loggingLevel: unknown level %q", c.LoggingLevel))
+	}
+	if c.SlackEndpoint != "" {
+		if !isHTTPURL(c.SlackEndpoint) {
+			problems = append(problems, "slackEndpoint: must be an http(s) URL")
+		}
+	}
+	if c.DownloadThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("downloadThreshold: must not be negative, got %v", c.DownloadThreshold))
+	}
+	if c.UploadThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("uploadThreshold: must not be negative, got %v", c.UploadThreshold))
+	}
+	if c.LatencyThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("latencyThreshold: must not be negative, got %v", c.LatencyThreshold))
+	}
+	for _, t := range []struct {
+		key   string
+		value float64
+	}{
+		{"dnsThreshold", c.DNSThreshold},
+		{"connectThreshold", c.ConnectThreshold},
+		{"tlsThreshold", c.TLSThreshold},
+		{"ttfbThreshold", c.TTFBThreshold},
+	} {
+		if t.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative, got %v", t.key, t.value))
+		}
+	}
+	if (c.Latitude == nil) != (c.Longitude == nil) {
+		problems = append(problems, "latitude and longitude: must be set together")
+	}
+	if c.Latitude != nil && (*c.Latitude < -90 || *c.Latitude > 90) {
+		problems = append(problems, fmt.Sprintf("latitude: must be between -90 and 90, got %v", *c.Latitude))
+	}
+	if c.Longitude != nil && (*c.Longitude < -180 || *c.Longitude > 180) {
+		problems = append(problems, fmt.Sprintf("longitude: must be between -180 and 180, got %v", *c.Longitude))
+	}
+	if c.City != "" {
+		if _, _, ok := speedtest.LookupCity(c.City); !ok {
+			problems = append(problems, fmt.Sprintf("city: unknown city %q", c.City))
+		}
+	}
+	if !contains(speedtest.BackendNames(), c.Backend) {
+		problems = append(problems, fmt.Sprintf("backend: must be one of %s, got %q", strings.Join(speedtest.BackendNames(), ", "), c.Backend))
+	}
+	if c.LibreSpeedServers == "" {
+		problems = append(problems, "libreSpeedServers: must not be empty")
+	}
+	if c.Backend == speedtest.BackendIperf3 && len(c.Iperf3Servers) == 0 {
+		problems = append(problems, "iperf3Servers: must not be empty with the iperf3 backend")
+	}
+	for _, server := range c.SpeedtestServers {
+		if !isHTTPURL(server) {
+			problems = append(problems, fmt.Sprintf("speedtestServers: must be http(s) URLs, got %q", server))
+		}
+	}
+	for _, server := range c.Iperf3Servers {
+		if strings.TrimSpace(server) == "" {
+			problems = append(problems, "iperf3Servers: servers must not be empty")
+		}
+	}
+	if c.Backend == speedtest.BackendHTTP && (c.HTTPDownloadURL == "" || c.HTTPUploadURL == "") {
+		problems = append(problems, "httpDownloadUrl and httpUploadUrl: must be set with the http backend")
+	}
+	for _, u := range []struct{ key, value string }{
+		{"httpDownloadUrl", c.HTTPDownloadURL},
+		{"httpUploadUrl", c.HTTPUploadURL},
+		{"httpPingUrl", c.HTTPPingURL},
+	} {
+		if u.value != "" && !isHTTPURL(strings.Replace(u.value, speedtest.BytesPlaceholder, "0", -1)) {
+			problems = append(problems, fmt.Sprintf("%s: must be an http(s) URL", u.key))
+		}
+	}
+	if !contains([]string{"HEAD", "GET"}, c.HTTPPingMethod) {
+		problems = append(problems, fmt.Sprintf("httpPingMethod: must be one of HEAD, GET, got %q", c.HTTPPingMethod))
+	}
+	for _, id := range c.Servers {
+		if id <= 0 {
+			problems = append(problems, fmt.Sprintf("servers: IDs must be positive, got %d", id))
+		}
+	}
+	if !contains(speedtest.Strategies, c.Strategy) {
+		problems = append(problems, fmt.Sprintf("strategy: must be one of %s, got %q", strings.Join(speedtest.Strategies, ", "), c.Strategy))
+	}
+	if c.SampleSize < 1 {
+		problems = append(problems, fmt.Sprintf("sampleSize: must be at least 1, got %d", c.SampleSize))
+	}
+	if c.SecondaryEvery < 1 {
+		problems = append(problems, fmt.Sprintf("secondaryEvery: must be at least 1, got %d", c.SecondaryEvery))
+	}
+	if !contains(speedtest.Aggregates, c.Aggregate) {
+		problems = append(problems, fmt.Sprintf("aggregate: must be one of %s, got %q", strings.Join(speedtest.Aggregates, ", "), c.Aggregate))
+	}
+	if c.HistorySize < 1 {
+		problems = append(problems, fmt.Sprintf("historySize: must be at least 1, got %d", c.HistorySize))
+	}
+	for _, r := range c.Resolvers {
+		if _, err := resolver.Address(r); err != nil {
+			problems = append(problems, fmt.Sprintf("resolvers: %s", err))
+		}
+	}
+	for _, host := range c.ResolverHosts {
+		if strings.TrimSpace(host) == "" {
+			problems = append(problems, "resolverHosts: hosts must not be empty")
+		}
+	}
+	if c.ResolverInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("resolverInterval: must be a positive number of seconds, got %d", c.ResolverInterval))
+	}
+	if c.ResolverThreshold < 0 {
+		problems = append(problems, fmt.Sprintf("resolverThreshold: must not be negative, got %v", c.ResolverThreshold))
+	}
+	if c.MaxSpeedRatio < 0 {
+		problems = append(problems, fmt.Sprintf("maxSpeedRatio: must not be negative, got %v", c.MaxSpeedRatio))
+	}
+	if c.MaxSpeedFactor < 0 {
+		problems = append(problems, fmt.Sprintf("maxSpeedFactor: must not be negative, got %v", c.MaxSpeedFactor))
+	}
+	return problems
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
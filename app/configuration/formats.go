@@ -0,0 +1,197 @@
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file formats
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// fileNames : names of the configuration file looked for in each search
+// directory, in order
+var fileNames = []string{"configuration.json", "configuration.yaml", "configuration.yml", "configuration.toml"}
+
+// FormatOf detects the format of a configuration file from its extension.
+// Files without a known extension are read as JSON.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// decodeValues decodes the top level keys of a configuration in the given
+// format, keeping their values as JSON so every format goes through the
+// same type checks
+func decodeValues(data []byte, format string) (map[string]json.RawMessage, error) {
+	if format == FormatJSON {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("malformed JSON: %s", err)
+		}
+		return values, nil
+	}
+
+	generic := map[string]interface{}{}
+	switch format {
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return nil, fmt.Errorf("malformed YAML: %s", err)
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &generic); err != nil {
+			return nil, fmt.Errorf("malformed TOML: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	values := map[string]json.RawMessage{}
+	for key, value := range generic {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		values[key] = raw
+	}
+	return values, nil
+}
+
+// encodeValues encodes the top level keys of a configuration in the given
+// format, sorted by key
+func encodeValues(values map[string]json.RawMessage, format string) ([]byte, error) {
+	generic := map[string]interface{}{}
+	for key, raw := range values {
+		value, err := genericValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		generic[key] = value
+	}
+
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(generic, "", "    ")
+		return append(data, '\n'), err
+	case FormatYAML:
+		return yaml.Marshal(generic)
+	case FormatTOML:
+		var buffer bytes.Buffer
+		err := toml.NewEncoder(&buffer).Encode(generic)
+		return buffer.Bytes(), err
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// patchYAML sets the top level keys of a YAML configuration in place, and
+// removes the ones whose value is nil, keeping the comments and the order
+// of the other keys
+func patchYAML(data []byte, values map[string]json.RawMessage, keys []string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("malformed YAML: %s", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("malformed YAML: expected a mapping of keys")
+	}
+
+	for _, key := range keys {
+		index := -1
+		for i := 0; i < len(root.Content); i += 2 {
+			if root.Content[i].Value == key {
+				index = i
+				break
+			}
+		}
+		raw, ok := values[key]
+		if !ok {
+			if index >= 0 {
+				root.Content = append(root.Content[:index], root.Content[index+2:]...)
+			}
+			continue
+		}
+		value, err := genericValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		node := &yaml.Node{}
+		if err := node.Encode(value); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		if index < 0 {
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, node)
+			continue
+		}
+		old := root.Content[index+1]
+		node.HeadComment, node.LineComment, node.FootComment = old.HeadComment, old.LineComment, old.FootComment
+		if node.Kind == yaml.ScalarNode && old.Kind == yaml.ScalarNode && node.Tag == old.Tag {
+			// Keep the quotes of the strings
+			node.Style = old.Style
+		}
+		root.Content[index+1] = node
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// genericValue decodes a JSON value, keeping the integers as such
+func genericValue(raw json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return plainNumbers(value), nil
+}
+
+// plainNumbers converts the JSON numbers of a decoded value into integers
+// or floats, so they keep their type in every format
+func plainNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = plainNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = plainNumbers(v[key])
+		}
+	}
+	return value
+}
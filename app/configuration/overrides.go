@@ -0,0 +1,183 @@
+package configuration
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// redacted : value shown instead of the secrets
+const redacted = "REDACTED"
+
+// Key describes a configuration key and the flag and environment variable
+// that override it. Patchable keys can be changed through Patch.
+type Key struct {
+	Name      string
+	Flag      string
+	Envar     string
+	Help      string
+	Secret    bool
+	Patchable bool
+}
+
+// Keys lists every configuration key, in the order of the Configuration
+// fields
+func Keys() []Key {
+	keys := []Key{}
+	t := reflect.TypeOf(Configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			continue
+		}
+		flag := field.Tag.Get("flag")
+		if flag == "" {
+			flag = splitWords(name, "-", unicode.ToLower)
+		}
+		keys = append(keys, Key{
+			Name:   name,
+			Flag:   flag,
+			Envar:  "SPEEDTEST_" + splitWords(name, "_", unicode.ToUpper),
+			Help:   field.Tag.Get("help"),
+			Secret:    field.Tag.Get("secret") == "true",
+			Patchable: field.Tag.Get("patch") == "true",
+		})
+	}
+	return keys
+}
+
+// splitWords converts a camelCase key into words joined by sep, mapping
+// each letter with fn
+func splitWords(key string, sep string, fn func(rune) rune) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(fn(r))
+	}
+	return b.String()
+}
+
+// ApplyOverrides sets the values given by key, as they come from flags or
+// environment variables, and validates the result. Overriding the city
+// discards the latitude and longitude of the file, unless they are also
+// overridden. The keys overridden can't be patched, as the file would no
+// longer apply to them.
+func (c *Configuration) ApplyOverrides(overrides map[string]string) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	if _, ok := overrides["city"]; ok {
+		if _, ok := overrides["latitude"]; !ok {
+			c.Latitude, c.Longitude = nil, nil
+		}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	fields := c.fields()
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown key %q", name))
+			continue
+		}
+		if err := setString(field, overrides[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		delete(c.references, name)
+		if c.overridden == nil {
+			c.overridden = map[string]bool{}
+		}
+		c.overridden[name] = true
+	}
+	problems = append(problems, c.resolveSecrets()...)
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return &ValidationError{Source: "flags and environment", Problems: problems}
+	}
+	return nil
+}
+
+// setString parses value into the field, according to its type
+func setString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		slice := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			elem := reflect.New(field.Type().Elem()).Elem()
+			if err := setString(elem, item); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		field.Set(slice)
+	case reflect.Ptr:
+		if value == "" {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		ptr := reflect.New(field.Type().Elem())
+		if err := setString(ptr.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(ptr)
+	default:
+		return fmt.Errorf("cannot be overridden")
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the secrets replaced,
+// safe to be logged, printed or returned by the API
+func (c *Configuration) Redacted() *Configuration {
+	clone := *c
+	fields := clone.fields()
+	for _, key := range Keys() {
+		if !key.Secret || fields[key.Name].String() == "" {
+			continue
+		}
+		// References don't hold the secret, and tell where it comes from
+		if ref, ok := c.Reference(key.Name); ok {
+			fields[key.Name].SetString(ref)
+		} else {
+			fields[key.Name].SetString(redacted)
+		}
+	}
+	return &clone
+}
@@ -0,0 +1,211 @@
+package configuration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Change describes the new value of a key, with the secrets redacted
+type Change struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// clone returns a deep copy of the configuration, so decoding into it
+// never writes into the pointers, slices and maps of the original
+func (c *Configuration) clone() *Configuration {
+	clone := *c
+	for _, field := range clone.fields() {
+		field.Set(deepCopy(field))
+	}
+	clone.references = map[string]string{}
+	for key, ref := range c.references {
+		clone.references[key] = ref
+	}
+	clone.overridden = map[string]bool{}
+	for key := range c.overridden {
+		clone.overridden[key] = true
+	}
+	return &clone
+}
+
+// deepCopy returns a copy of the value that shares no pointer, slice or map
+// with it
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type().Elem())
+		copied.Elem().Set(deepCopy(v.Elem()))
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(key, deepCopy(v.MapIndex(key)))
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// Patch returns a copy of the configuration with the keys of the JSON
+// object in data set, and the keys that were set. Only the patchable keys
+// not overridden by flags or environment variables can be set. The result
+// is validated as a whole, reporting every problem in a ValidationError.
+func (c *Configuration) Patch(data []byte) (*Configuration, []string, error) {
+	values, err := decodeValues(data, FormatJSON)
+	if err != nil {
+		return nil, nil, &ValidationError{Source: "request", Problems: []string{err.Error()}}
+	}
+	if problems := c.unpatchable(values); len(problems) > 0 {
+		return nil, nil, &ValidationError{Source: "request", Problems: problems}
+	}
+
+	patched := c.clone()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+		delete(patched.references, key)
+	}
+	problems := patched.decode(values)
+	problems = append(problems, patched.resolveSecrets()...)
+	problems = append(problems, patched.validate()...)
+	if len(problems) > 0 {
+		return nil, nil, &ValidationError{Source: "request", Problems: problems}
+	}
+	return patched, keys, nil
+}
+
+// unpatchable lists the keys of values that can't be patched
+func (c *Configuration) unpatchable(values map[string]json.RawMessage) []string {
+	problems := []string{}
+	for _, key := range Keys() {
+		if _, ok := values[key.Name]; !ok {
+			continue
+		}
+		if !key.Patchable {
+			problems = append(problems, fmt.Sprintf("%s can't be changed through the API", key.Name))
+		} else if c.overridden[key.Name] {
+			problems = append(problems, fmt.Sprintf("%s is set by a flag or an environment variable", key.Name))
+		}
+	}
+	return problems
+}
+
+// Diff lists the keys whose value differs between two configurations
+func Diff(old, new *Configuration) []Change {
+	changes := []Change{}
+	oldFields, newFields := old.fields(), new.fields()
+	oldRedacted, newRedacted := old.Redacted().fields(), new.Redacted().fields()
+	for _, key := range Keys() {
+		if !reflect.DeepEqual(oldFields[key.Name].Interface(), newFields[key.Name].Interface()) {
+			changes = append(changes, Change{
+				Key: key.Name,
+				Old: plainValue(oldRedacted[key.Name]),
+				New: plainValue(newRedacted[key.Name]),
+			})
+		}
+	}
+	return changes
+}
+
+// plainValue returns the value of a field, dereferencing the pointers
+func plainValue(field reflect.Value) interface{} {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return nil
+		}
+		return field.Elem().Interface()
+	}
+	return field.Interface()
+}
+
+// Persist writes the value of the keys back to the configuration file, in
+// its format, leaving the other keys of the file as they are. Secrets are
+// written as their reference, when they have one. YAML files keep their
+// comments and the order of their keys, while TOML files can't be written,
+// as their comments would be lost.
+func (c *Configuration) Persist(keys []string) error {
+	if c.path == "" {
+		return fmt.Errorf("the configuration wasn't loaded from a file")
+	}
+	format := FormatOf(c.path)
+	if format == FormatTOML {
+		return fmt.Errorf("TOML config files can't be written back without losing their comments, use a JSON or YAML file")
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("error while reading config file: %s", err)
+	}
+	values, err := decodeValues(data, format)
+	if err != nil {
+		return err
+	}
+
+	fields := c.fields()
+	for _, key := range keys {
+		var value interface{} = fields[key].Interface()
+		if ref, ok := c.Reference(key); ok {
+			value = ref
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		if bytes.Equal(raw, []byte("null")) {
+			delete(values, key)
+		} else {
+			values[key] = raw
+		}
+	}
+
+	if format == FormatYAML {
+		data, err = patchYAML(data, values, keys)
+	} else {
+		data, err = encodeValues(values, format)
+	}
+	if err != nil {
+		return err
+	}
+	// Replace the file at once, so it's never read half written
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".configuration")
+	if err != nil {
+		return fmt.Errorf("error while writing config file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error while writing config file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error while writing config file: %s", err)
+	}
+	if info, err := os.Stat(c.path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("error while writing config file: %s", err)
+	}
+	return nil
+}
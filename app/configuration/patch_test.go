@@ -0,0 +1,169 @@
+package configuration
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withLists returns a configuration with every list set
+func withLists() *Configuration {
+	conf := Defaults()
+	conf.SpeedtestServers = []string{"http://a.example.com/upload.php", "http://b.example.com/upload.php"}
+	conf.Iperf3Servers = []string{"10.0.0.1", "10.0.0.2"}
+	conf.Resolvers = []string{"system", "1.1.1.1"}
+	conf.ResolverHosts = []string{"example.com", "example.org"}
+	conf.Servers = []int{1, 2}
+	return conf
+}
+
+func TestPatchRejectedKeepsLists(t *testing.T) {
+	current, before := withLists(), withLists()
+
+	_, _, err := current.Patch([]byte(`{
+		"speedtestServers": ["http://c.example.com/upload.php"],
+		"iperf3Servers": ["10.0.0.3"],
+		"resolvers": ["9.9.9.9"],
+		"resolverHosts": ["example.net"],
+		"servers": [3],
+		"interval": -1
+	}`))
+	if err == nil {
+		t.Fatal("expected the patch to be rejected")
+	}
+	for key, field := range current.fields() {
+		if want := before.fields()[key].Interface(); !reflect.DeepEqual(field.Interface(), want) {
+			t.Errorf("%s changed by a rejected patch: got %v, want %v", key, field.Interface(), want)
+		}
+	}
+}
+
+func TestPatchAcceptedIsDiffed(t *testing.T) {
+	current := Defaults()
+	current.Iperf3Servers = []string{"10.0.0.1", "10.0.0.2"}
+
+	patched, keys, err := current.Patch([]byte(`{"iperf3Servers": ["10.0.0.3", "10.0.0.2"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"iperf3Servers"}) {
+		t.Errorf("got keys %v", keys)
+	}
+	if !reflect.DeepEqual(current.Iperf3Servers, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("current iperf3 servers changed to %v", current.Iperf3Servers)
+	}
+	changes := Diff(current, patched)
+	if len(changes) != 1 || changes[0].Key != "iperf3Servers" {
+		t.Errorf("got changes %+v, want a change of iperf3Servers", changes)
+	}
+}
+
+func TestPatchRejectsKeys(t *testing.T) {
+	current := Defaults()
+	if err := current.ApplyOverrides(map[string]string{"interval": "600"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := current.Patch([]byte(`{
+		"apiToken": "secret",
+		"historyFile": "/etc/passwd",
+		"slackEndpoint": "file:/etc/shadow",
+		"interval": 900,
+		"downloadThreshold": 50
+	}`))
+	validation, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("got the error %v, want a ValidationError", err)
+	}
+	want := []string{
+		"interval is set by a flag or an environment variable",
+		"slackEndpoint can't be changed through the API",
+		"historyFile can't be changed through the API",
+		"apiToken can't be changed through the API",
+	}
+	if !reflect.DeepEqual(validation.Problems, want) {
+		t.Errorf("got the problems %q, want %q", validation.Problems, want)
+	}
+
+	// The overrides are kept by the patched configurations
+	patched, _, err := current.Patch([]byte(`{"downloadThreshold": 50}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := patched.Patch([]byte(`{"interval": 900}`)); err == nil {
+		t.Error("expected the overridden interval to be rejected")
+	}
+}
+
+func TestPersistYAMLKeepsComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "configuration.yaml")
+	original := `# Monitor of the office link
+httpPingUrl: "http://office.example.com/ping" # shown in the alerts
+interval: 1800
+# Alert below these speeds
+downloadThreshold: 100
+iperf3Servers:
+  - 10.0.0.1
+`
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	current, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, keys, err := current.Patch([]byte(`{"httpPingUrl": "http://branch.example.com/ping", "interval": 900, "iperf3Servers": ["10.0.0.1", "10.0.0.2"], "uploadThreshold": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := patched.Persist(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Monitor of the office link
+httpPingUrl: "http://branch.example.com/ping" # shown in the alerts
+interval: 900
+# Alert below these speeds
+downloadThreshold: 100
+iperf3Servers:
+  - 10.0.0.1
+  - 10.0.0.2
+uploadThreshold: 10
+`
+	if string(data) != want {
+		t.Errorf("got file:\n%s\nwant:\n%s", data, want)
+	}
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Diff(patched, reloaded)) != 0 {
+		t.Errorf("reloaded configuration differs: %+v", Diff(patched, reloaded))
+	}
+}
+
+func TestPersistTOMLRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "configuration.toml")
+	if err := ioutil.WriteFile(path, []byte("# Comment\ninterval = 1800\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	current, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, keys, err := current.Patch([]byte(`{"interval": 900}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := patched.Persist(keys); err == nil {
+		t.Error("expected TOML files not to be written")
+	}
+	if _, err := Parse([]byte("persistConfig = true\n"), path); err == nil {
+		t.Error("expected persistConfig to be rejected with a TOML file")
+	}
+}
@@ -0,0 +1,77 @@
+package configuration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Prefixes of the secret values that reference a file or an environment
+// variable instead of holding the secret itself
+const (
+	filePrefix = "file:"
+	envPrefix  = "env:"
+)
+
+// isReference tells if a secret value is a reference to be resolved
+func isReference(value string) bool {
+	return strings.HasPrefix(value, filePrefix) || strings.HasPrefix(value, envPrefix)
+}
+
+// resolveSecret returns the secret referenced by value. Values that aren't
+// a reference are returned as they are.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, filePrefix):
+		path := strings.TrimPrefix(value, filePrefix)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret file %s: %s", path, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(value, envPrefix):
+		name := strings.TrimPrefix(value, envPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return strings.TrimSpace(secret), nil
+	default:
+		return value, nil
+	}
+}
+
+// resolveSecrets replaces the secret values given as `file:<path>` or
+// `env:<name>` with the content of the file or environment variable,
+// remembering the references
+func (c *Configuration) resolveSecrets() []string {
+	problems := []string{}
+	fields := c.fields()
+	for _, key := range Keys() {
+		field := fields[key.Name]
+		if !key.Secret || !isReference(field.String()) {
+			continue
+		}
+		secret, err := resolveSecret(field.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", key.Name, err))
+			// Leave it unset, so the reference isn't also reported as invalid
+			field.SetString("")
+			continue
+		}
+		if c.references == nil {
+			c.references = map[string]string{}
+		}
+		c.references[key.Name] = field.String()
+		field.SetString(secret)
+	}
+	return problems
+}
+
+// Reference returns the `file:` or `env:` reference the secret of the
+// key was loaded from, if any
+func (c *Configuration) Reference(key string) (string, bool) {
+	ref, ok := c.references[key]
+	return ref, ok
+}
@@ -0,0 +1,115 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	spt "github.com/speedtest-monitor/app/speedtest"
+)
+
+// Output formats of the results
+const (
+	FormatJSON  = "json"
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+	FormatTSV   = "tsv"
+	FormatText  = "text"
+)
+
+// Formats : every output format
+var Formats = []string{FormatText, FormatJSON, FormatJSONL, FormatCSV, FormatTSV}
+
+// columns : header of the tabular formats
+var columns = []string{"timestamp", "quality", "download_mbps", "upload_mbps", "ping_ms", "jitter_ms", "bytes_received", "bytes_sent", "servers", "error", "dns_ms", "connect_ms", "tls_ms", "ttfb_ms"}
+
+// Write writes the results to w in the given format
+func Write(w io.Writer, results []spt.Result, format string) error {
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		for _, result := range results {
+			if err := encoder.Encode(result); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV, FormatTSV:
+		writer := csv.NewWriter(w)
+		if format == FormatTSV {
+			writer.Comma = '\t'
+		}
+		writer.Write(columns)
+		for _, result := range results {
+			writer.Write(row(result))
+		}
+		writer.Flush()
+		return writer.Error()
+	case FormatText:
+		writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "TIME\tQUALITY\tDOWNLOAD\tUPLOAD\tPING\tJITTER\tDNS\tTTFB\tSERVERS\tERROR")
+		for _, r := range results {
+			fmt.Fprintf(writer, "%s\t%s\t%.2f Mbit/s\t%.2f Mbit/s\t%.2f ms\t%.2f ms\t%.2f ms\t%.2f ms\t%s\t%s\n",
+				r.Timestamp.Local().Format("2006-01-02 15:04:05"), r.Quality, r.DownloadMbps(), r.UploadMbps(),
+				r.PingMs, r.JitterMs, r.DNSMs, r.TTFBMs, serverIDs(r), r.Error)
+		}
+		return writer.Flush()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// WriteResult writes a single result to w in the given format. Unlike
+// Write, the JSON format is an object instead of an array.
+func WriteResult(w io.Writer, result spt.Result, format string) error {
+	if format == FormatJSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	return Write(w, []spt.Result{result}, format)
+}
+
+// row returns the columns of a result in the tabular formats
+func row(r spt.Result) []string {
+	return []string{
+		r.Timestamp.Format(time.RFC3339),
+		r.Quality,
+		strconv.FormatFloat(r.DownloadMbps(), 'f', 3, 64),
+		strconv.FormatFloat(r.UploadMbps(), 'f', 3, 64),
+		strconv.FormatFloat(r.PingMs, 'f', 3, 64),
+		strconv.FormatFloat(r.JitterMs, 'f', 3, 64),
+		strconv.FormatInt(r.BytesReceived, 10),
+		strconv.FormatInt(r.BytesSent, 10),
+		serverIDs(r),
+		r.Error,
+		strconv.FormatFloat(r.DNSMs, 'f', 3, 64),
+		strconv.FormatFloat(r.ConnectMs, 'f', 3, 64),
+		strconv.FormatFloat(r.TLSMs, 'f', 3, 64),
+		strconv.FormatFloat(r.TTFBMs, 'f', 3, 64),
+	}
+}
+
+// serverIDs returns the IDs of the servers of a result, separated by spaces
+func serverIDs(r spt.Result) string {
+	ids := make([]string, 0, len(r.Servers))
+	for _, s := range r.Servers {
+		ids = append(ids, s.ID)
+	}
+	return strings.Join(ids, " ")
+}
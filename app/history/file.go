@@ -0,0 +1,171 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	spt "github.com/speedtest-monitor/app/speedtest"
+)
+
+// maxLineSize : largest result line read from a history file
+const maxLineSize = 1 << 20
+
+// ReadFile reads the results stored in a history file, one JSON result per
+// line, oldest first. A missing file has no results.
+func ReadFile(path string) ([]spt.Result, error) {
+	results := []spt.Result{}
+	err := readLines(path, func(line []byte) error {
+		var result spt.Result
+		if err := json.Unmarshal(line, &result); err != nil {
+			return err
+		}
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// readLines decodes every line of a history file, skipping the malformed
+// ones. A missing file has no lines.
+func readLines(path string, decode func(line []byte) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while reading history file: %s", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := decode(scanner.Bytes()); err != nil {
+			log.Warnf("Skipping malformed line in %s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error while reading history file: %s", err)
+	}
+	return nil
+}
+
+// openFile opens a history file to append to it
+func openFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening history file: %s", err)
+	}
+	return file, nil
+}
+
+// writeLine appends a value to a history file as a JSON line, if any
+func writeLine(file *os.File, value interface{}) {
+	if file == nil {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Errorf("Error while writing to history file: %s", err)
+	}
+}
+
+// Open loads the latest results stored in the history file, merged by time
+// with the ones in memory, and appends every result added from now on to it
+func (h *History) Open(path string) error {
+	results, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, err := openFile(path)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file = file
+	h.path = path
+	if len(results) > h.size {
+		results = results[len(results)-h.size:]
+	}
+	h.results = mergeResults(results, h.results)
+	if len(h.results) > h.size {
+		h.results = h.results[len(h.results)-h.size:]
+	}
+	log.Debugf("Loaded %d results from history file %s", len(results), path)
+	return nil
+}
+
+// mergeResults merges two lists of results sorted by time, keeping a
+// single result of each time
+func mergeResults(a, b []spt.Result) []spt.Result {
+	merged := make([]spt.Result, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		var next spt.Result
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].Timestamp.Before(b[0].Timestamp)):
+			next, a = a[0], a[1:]
+		case len(a) == 0 || b[0].Timestamp.Before(a[0].Timestamp):
+			next, b = b[0], b[1:]
+		default:
+			next, a, b = a[0], a[1:], b[1:]
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// Close stops appending the results to the history file
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	h.path = ""
+	return err
+}
+
+// Since returns the results since the given time, oldest first. When the
+// results kept in memory don't go back that far, they are read from the
+// history file, if any.
+func (h *History) Since(since time.Time) []spt.Result {
+	h.mu.RLock()
+	results, path := append([]spt.Result{}, h.results...), h.path
+	full := len(h.results) >= h.size
+	h.mu.RUnlock()
+
+	if path != "" && full && results[0].Timestamp.After(since) {
+		stored, err := ReadFile(path)
+		if err == nil {
+			results = stored
+		} else {
+			log.Warnf("Serving the results kept in memory only: %s", err)
+		}
+	}
+	return Filter(results, since, "")
+}
+
+// write appends the result to the history file, if any
+func (h *History) write(result spt.Result) {
+	writeLine(h.file, result)
+}
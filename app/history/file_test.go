@@ -0,0 +1,81 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	spt "github.com/speedtest-monitor/app/speedtest"
+)
+
+func TestOpenMergesResults(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours ...int) []time.Time {
+		times := []time.Time{}
+		for _, h := range hours {
+			times = append(times, start.Add(time.Duration(h)*time.Hour))
+		}
+		return times
+	}
+
+	// The new file has older and newer results than the first one
+	stored := NewHistory(10)
+	if err := stored.Open(filepath.Join(dir, "new.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	for _, timestamp := range at(0, 2, 5) {
+		stored.Add(spt.Result{Timestamp: timestamp})
+	}
+	stored.Close()
+
+	h := NewHistory(4)
+	if err := h.Open(filepath.Join(dir, "old.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	for _, timestamp := range at(1, 2, 3) {
+		h.Add(spt.Result{Timestamp: timestamp})
+	}
+	if err := h.Open(filepath.Join(dir, "new.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// The oldest result is left out, and the one of both is kept once
+	want := at(1, 2, 3, 5)
+	results := h.Results()
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if !result.Timestamp.Equal(want[i]) {
+			t.Errorf("result %d at %s, want %s", i, result.Timestamp, want[i])
+		}
+	}
+}
+
+func TestSinceReadsFile(t *testing.T) {
+	h := NewHistory(3)
+	if err := h.Open(filepath.Join(t.TempDir(), "history.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	now := time.Now().UTC()
+	for i := 10; i > 0; i-- {
+		h.Add(spt.Result{Timestamp: now.Add(-time.Duration(i) * time.Hour)})
+	}
+
+	// The results in memory cover the last 3 hours only
+	for _, test := range []struct {
+		since time.Time
+		want  int
+	}{
+		{now.Add(-150 * time.Minute), 2},
+		{now.Add(-450 * time.Minute), 7},
+		{time.Time{}, 10},
+	} {
+		if got := len(h.Since(test.since)); got != test.want {
+			t.Errorf("got %d results since %s, want %d", got, test.since, test.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package history
+
+import (
+	"os"
+	"sync"
+
+	spt "github.com/speedtest-monitor/app/speedtest"
+)
+
+// History keeps the most recent speedtest results in memory, and
+// optionally stores every result in a file, see Open
+type History struct {
+	mu      sync.RWMutex
+	size    int
+	results []spt.Result
+	file    *os.File
+	path    string
+}
+
+// NewHistory creates a History that keeps up to size results
+func NewHistory(size int) *History {
+	if size < 1 {
+		size = 1
+	}
+	return &History{size: size}
+}
+
+// Add stores a copy of the result, discarding the oldest one if the
+// history is full
+func (h *History) Add(result spt.Result) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result.Servers = append([]spt.ServerMeasurement{}, result.Servers...)
+	h.results = append(h.results, result)
+	if len(h.results) > h.size {
+		h.results = h.results[len(h.results)-h.size:]
+	}
+	h.write(result)
+}
+
+// Resize changes the number of results kept, discarding the oldest ones
+// if there are more
+func (h *History) Resize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if size < 1 {
+		size = 1
+	}
+	h.size = size
+	if len(h.results) > h.size {
+		h.results = h.results[len(h.results)-h.size:]
+	}
+}
+
+// Results returns the stored results, oldest first
+func (h *History) Results() []spt.Result {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return append([]spt.Result{}, h.results...)
+}
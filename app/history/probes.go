@@ -0,0 +1,151 @@
+package history
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/speedtest-monitor/app/resolver"
+)
+
+// Probes keeps the most recent DNS resolver probes in memory, and
+// optionally stores every probe in a file, like History does with the
+// results
+type Probes struct {
+	mu     sync.RWMutex
+	size   int
+	probes []resolver.Probe
+	file   *os.File
+}
+
+// NewProbes creates a Probes that keeps up to size probes
+func NewProbes(size int) *Probes {
+	if size < 1 {
+		size = 1
+	}
+	return &Probes{size: size}
+}
+
+// Add stores the probe, discarding the oldest one if the history is full
+func (h *Probes) Add(probe resolver.Probe) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.probes = append(h.probes, probe)
+	if len(h.probes) > h.size {
+		h.probes = h.probes[len(h.probes)-h.size:]
+	}
+	writeLine(h.file, probe)
+}
+
+// Resize changes the number of probes kept, discarding the oldest ones if
+// there are more
+func (h *Probes) Resize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if size < 1 {
+		size = 1
+	}
+	h.size = size
+	if len(h.probes) > h.size {
+		h.probes = h.probes[len(h.probes)-h.size:]
+	}
+}
+
+// Probes returns the stored probes, oldest first
+func (h *Probes) Probes() []resolver.Probe {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return append([]resolver.Probe{}, h.probes...)
+}
+
+// ReadProbes reads the probes stored in a history file, one JSON probe per
+// line, oldest first. A missing file has no probes.
+func ReadProbes(path string) ([]resolver.Probe, error) {
+	probes := []resolver.Probe{}
+	err := readLines(path, func(line []byte) error {
+		var probe resolver.Probe
+		if err := json.Unmarshal(line, &probe); err != nil {
+			return err
+		}
+		probes = append(probes, probe)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return probes, nil
+}
+
+// Open loads the latest probes stored in the history file, merged by time
+// with the ones in memory, and appends every probe added from now on to it
+func (h *Probes) Open(path string) error {
+	probes, err := ReadProbes(path)
+	if err != nil {
+		return err
+	}
+	file, err := openFile(path)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file = file
+	h.probes = mergeProbes(probes, h.probes)
+	if len(h.probes) > h.size {
+		h.probes = h.probes[len(h.probes)-h.size:]
+	}
+	log.Debugf("Loaded %d probes from history file %s", len(probes), path)
+	return nil
+}
+
+// mergeProbes merges two lists of probes sorted by time, keeping a single
+// probe of each time
+func mergeProbes(a, b []resolver.Probe) []resolver.Probe {
+	merged := make([]resolver.Probe, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		var next resolver.Probe
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].Timestamp.Before(b[0].Timestamp)):
+			next, a = a[0], a[1:]
+		case len(a) == 0 || b[0].Timestamp.Before(a[0].Timestamp):
+			next, b = b[0], b[1:]
+		default:
+			next, a, b = a[0], a[1:], b[1:]
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// Close stops appending the probes to the history file
+func (h *Probes) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// FilterProbes returns the probes since the given time. A zero since
+// doesn't filter.
+func FilterProbes(probes []resolver.Probe, since time.Time) []resolver.Probe {
+	filtered := []resolver.Probe{}
+	for _, probe := range probes {
+		if !probe.Timestamp.Before(since) {
+			filtered = append(filtered, probe)
+		}
+	}
+	return filtered
+}
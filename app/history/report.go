@@ -0,0 +1,109 @@
+package history
+
+import (
+	"sort"
+	"time"
+
+	spt "github.com/speedtest-monitor/app/speedtest"
+)
+
+// Stats : summary of a measurement over several results
+type Stats struct {
+	Min    float64 `json:"min"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Max    float64 `json:"max"`
+}
+
+// Report : summary of the results of a period. Speeds are in Mbit/s and
+// times in milliseconds, and only the results of ok quality are measured.
+type Report struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Tests         int       `json:"tests"`
+	OK            int       `json:"ok"`
+	Suspect       int       `json:"suspect"`
+	Failed        int       `json:"failed"`
+	DownloadMbps  Stats     `json:"downloadMbps"`
+	UploadMbps    Stats     `json:"uploadMbps"`
+	PingMs        Stats     `json:"pingMs"`
+	JitterMs      Stats     `json:"jitterMs"`
+	BelowDownload int       `json:"belowDownloadThreshold"`
+	BelowUpload   int       `json:"belowUploadThreshold"`
+}
+
+// Filter returns the results since the given time, of the given quality.
+// A zero since or an empty quality don't filter.
+func Filter(results []spt.Result, since time.Time, quality string) []spt.Result {
+	filtered := []spt.Result{}
+	for _, result := range results {
+		if result.Timestamp.Before(since) {
+			continue
+		}
+		if quality != "" && result.Quality != quality {
+			continue
+		}
+		filtered = append(filtered, result)
+	}
+	return filtered
+}
+
+// NewReport summarizes the results, counting the ones below the download
+// and upload thresholds, in Mbit/s
+func NewReport(results []spt.Result, downloadThreshold, uploadThreshold float64) Report {
+	report := Report{Tests: len(results)}
+	var download, upload, ping, jitter []float64
+	for _, result := range results {
+		if report.From.IsZero() || result.Timestamp.Before(report.From) {
+			report.From = result.Timestamp
+		}
+		if result.Timestamp.After(report.To) {
+			report.To = result.Timestamp
+		}
+		switch result.Quality {
+		case spt.QualitySuspect:
+			report.Suspect++
+			continue
+		case spt.QualityFailed:
+			report.Failed++
+			continue
+		}
+		report.OK++
+		download = append(download, result.DownloadMbps())
+		upload = append(upload, result.UploadMbps())
+		ping = append(ping, result.PingMs)
+		jitter = append(jitter, result.JitterMs)
+		if result.DownloadMbps() < downloadThreshold {
+			report.BelowDownload++
+		}
+		if result.UploadMbps() < uploadThreshold {
+			report.BelowUpload++
+		}
+	}
+	report.DownloadMbps = newStats(download)
+	report.UploadMbps = newStats(upload)
+	report.PingMs = newStats(ping)
+	report.JitterMs = newStats(jitter)
+	return report
+}
+
+func newStats(values []float64) Stats {
+	if len(values) == 0 {
+		return Stats{}
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	stats := Stats{Min: sorted[0], Max: sorted[len(sorted)-1]}
+	for _, v := range sorted {
+		stats.Mean += v
+	}
+	stats.Mean /= float64(len(sorted))
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		stats.Median = (sorted[middle-1] + sorted[middle]) / 2
+	} else {
+		stats.Median = sorted[middle]
+	}
+	return stats
+}
@@ -0,0 +1,203 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// System : name of the resolver of the operating system, as configured in
+// /etc/resolv.conf or its equivalent
+const System = "system"
+
+// DefaultPort : port of the resolvers given without one
+const DefaultPort = "53"
+
+// lookupTimeout : time to wait for the answer of a resolver
+const lookupTimeout = 5 * time.Second
+
+// Lookup : resolution of a hostname by a resolver. The latency is in
+// milliseconds, and the addresses are sorted. Changed is set when the
+// addresses differ from the previous answer of the resolver, which is kept
+// in Previous.
+type Lookup struct {
+	Resolver  string   `json:"resolver"`
+	Host      string   `json:"host"`
+	LatencyMs float64  `json:"latencyMs"`
+	Addresses []string `json:"addresses"`
+	Error     string   `json:"error,omitempty"`
+	Changed   bool     `json:"changed,omitempty"`
+	Previous  []string `json:"previous,omitempty"`
+}
+
+// Failed returns whether the resolver failed to answer
+func (l Lookup) Failed() bool {
+	return l.Error != ""
+}
+
+// Probe : lookups of every host against every resolver, made at the same
+// time
+type Probe struct {
+	Timestamp time.Time `json:"timestamp"`
+	Lookups   []Lookup  `json:"lookups"`
+}
+
+// Failures returns the number of failed lookups of the probe
+func (p Probe) Failures() int {
+	failures := 0
+	for _, l := range p.Lookups {
+		if l.Failed() {
+			failures++
+		}
+	}
+	return failures
+}
+
+// Address returns the address, host:port, to query a resolver given as an
+// IP with an optional port. It's empty for the System resolver.
+func Address(resolver string) (string, error) {
+	if resolver == System {
+		return "", nil
+	}
+	if ip := net.ParseIP(resolver); ip != nil {
+		return net.JoinHostPort(resolver, DefaultPort), nil
+	}
+	host, port, err := net.SplitHostPort(resolver)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("expected %s or an IP with an optional port, got %q", System, resolver)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port in %q", resolver)
+	}
+	return resolver, nil
+}
+
+// Prober resolves the hosts against the resolvers, remembering the latest
+// answer of each resolver to detect the changes
+type Prober struct {
+	mu        sync.Mutex
+	resolvers []string
+	hosts     []string
+	answers   map[string][]string
+}
+
+// NewProber creates a prober of the hosts against the resolvers, see
+// Address for the format of the resolvers
+func NewProber(resolvers []string, hosts []string) *Prober {
+	p := &Prober{answers: map[string][]string{}}
+	p.SetTargets(resolvers, hosts)
+	return p
+}
+
+// SetTargets changes the resolvers and hosts probed. The answers of the
+// ones kept are still compared with the next ones.
+func (p *Prober) SetTargets(resolvers []string, hosts []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resolvers = append([]string{}, resolvers...)
+	p.hosts = append([]string{}, hosts...)
+}
+
+// Enabled returns whether there is anything to probe
+func (p *Prober) Enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.resolvers) > 0 && len(p.hosts) > 0
+}
+
+// Run resolves every host against every resolver at the same time. The
+// lookups are in the order of the resolvers, then of the hosts.
+func (p *Prober) Run() Probe {
+	p.mu.Lock()
+	resolvers, hosts := p.resolvers, p.hosts
+	p.mu.Unlock()
+
+	probe := Probe{Timestamp: time.Now().UTC(), Lookups: make([]Lookup, len(resolvers)*len(hosts))}
+	var wg sync.WaitGroup
+	for i, resolver := range resolvers {
+		for j, host := range hosts {
+			wg.Add(1)
+			go func(n int, resolver string, host string) {
+				defer wg.Done()
+				probe.Lookups[n] = lookup(resolver, host)
+			}(i*len(hosts)+j, resolver, host)
+		}
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, l := range probe.Lookups {
+		if l.Failed() {
+			log.Warnf("DNS resolver %s failed to resolve %s: %s", l.Resolver, l.Host, l.Error)
+			continue
+		}
+		key := l.Resolver + " " + l.Host
+		if previous, ok := p.answers[key]; ok && !equal(previous, l.Addresses) {
+			probe.Lookups[i].Changed = true
+			probe.Lookups[i].Previous = previous
+			log.Infof("DNS resolver %s answer for %s changed from %s to %s", l.Resolver, l.Host, strings.Join(previous, " "), strings.Join(l.Addresses, " "))
+		}
+		p.answers[key] = l.Addresses
+		log.Debugf("DNS resolver %s resolved %s in %.2f ms: %s", l.Resolver, l.Host, l.LatencyMs, strings.Join(l.Addresses, " "))
+	}
+	return probe
+}
+
+// lookup resolves the host against the resolver, timing it
+func lookup(resolver string, host string) Lookup {
+	result := Lookup{Resolver: resolver, Host: host, Addresses: []string{}}
+	address, err := Address(resolver)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	r := net.DefaultResolver
+	if address != "" {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := r.LookupHost(ctx, host)
+	result.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+		// The message names the server of the system configuration, keep
+		// only the cause
+		if dnsErr, ok := err.(*net.DNSError); ok {
+			result.Error = dnsErr.Err
+		}
+		return result
+	}
+	sort.Strings(addrs)
+	result.Addresses = addrs
+	return result
+}
+
+// equal returns whether both sorted answers have the same addresses
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeResolver : DNS server on 127.0.0.1 answering the A queries with its
+// address, and failing those of fail.test
+type fakeResolver struct {
+	conn    net.PacketConn
+	address atomic.Value
+}
+
+func startResolver(t *testing.T, address string) *fakeResolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeResolver{conn: conn}
+	r.address.Store(address)
+	go r.serve()
+	t.Cleanup(func() { conn.Close() })
+	return r
+}
+
+func (r *fakeResolver) serve() {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := r.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := r.answer(buffer[:n]); response != nil {
+			r.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// answer returns the response to the query, with its question only
+func (r *fakeResolver) answer(query []byte) []byte {
+	labels := []string{}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		size := int(query[i])
+		if i+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+size]))
+		i += size + 1
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+
+	response := append([]byte{}, query[:i+5]...)
+	response[2], response[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(response[6:], 0)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	switch {
+	case strings.Join(labels, ".") == "fail.test":
+		// SERVFAIL
+		response[3] = 0x82
+	case qtype == 1:
+		binary.BigEndian.PutUint16(response[6:], 1)
+		response = append(response, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		response = append(response, net.ParseIP(r.address.Load().(string)).To4()...)
+	}
+	return response
+}
+
+func TestAddress(t *testing.T) {
+	tests := []struct {
+		resolver string
+		address  string
+		err      bool
+	}{
+		{System, "", false},
+		{"1.1.1.1", "1.1.1.1:53", false},
+		{"2606:4700:4700::1111", "[2606:4700:4700::1111]:53", false},
+		{"9.9.9.9:5353", "9.9.9.9:5353", false},
+		{"[::1]:5353", "[::1]:5353", false},
+		{"9.9.9.9:0", "", true},
+		{"9.9.9.9:65536", "", true},
+		{"9.9.9.9:dns", "", true},
+		{"dns.example.com", "", true},
+		{"dns.example.com:53", "", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		address, err := Address(test.resolver)
+		if address != test.address || (err != nil) != test.err {
+			t.Errorf("Address(%q) = %q, %v, want %q (error: %v)", test.resolver, address, err, test.address, test.err)
+		}
+	}
+}
+
+func TestProberRun(t *testing.T) {
+	r := startResolver(t, "192.0.2.1")
+	address := r.conn.LocalAddr().String()
+	// Nothing listens on port 1
+	p := NewProber([]string{address, "127.0.0.1:1"}, []string{"ok.test", "fail.test"})
+
+	probe := p.Run()
+	if len(probe.Lookups) != 4 {
+		t.Fatalf("got %d lookups, want 4", len(probe.Lookups))
+	}
+	ok, failed := probe.Lookups[0], probe.Lookups[1]
+	if ok.Resolver != address || ok.Host != "ok.test" || ok.Failed() || !reflect.DeepEqual(ok.Addresses, []string{"192.0.2.1"}) {
+		t.Errorf("unexpected lookup %+v", ok)
+	}
+	if ok.Changed || ok.Previous != nil {
+		t.Errorf("the first answer is marked as changed: %+v", ok)
+	}
+	if !failed.Failed() || len(failed.Addresses) != 0 {
+		t.Errorf("expected the lookup of fail.test to fail: %+v", failed)
+	}
+	for _, l := range probe.Lookups[2:] {
+		if l.Resolver != "127.0.0.1:1" || !l.Failed() {
+			t.Errorf("expected the lookup against the unreachable resolver to fail: %+v", l)
+		}
+	}
+	if probe.Failures() != 3 {
+		t.Errorf("got %d failures, want 3", probe.Failures())
+	}
+
+	probe = p.Run()
+	if l := probe.Lookups[0]; l.Changed {
+		t.Errorf("the same answer is marked as changed: %+v", l)
+	}
+
+	r.address.Store("192.0.2.2")
+	probe = p.Run()
+	l := probe.Lookups[0]
+	if !l.Changed || !reflect.DeepEqual(l.Previous, []string{"192.0.2.1"}) || !reflect.DeepEqual(l.Addresses, []string{"192.0.2.2"}) {
+		t.Errorf("expected the answer to change from 192.0.2.1: %+v", l)
+	}
+	if failed := probe.Lookups[1]; failed.Changed {
+		t.Errorf("a failed lookup is marked as changed: %+v", failed)
+	}
+}
+
+func TestProberTargets(t *testing.T) {
+	p := NewProber([]string{"bad resolver"}, nil)
+	if p.Enabled() {
+		t.Error("a prober without hosts is enabled")
+	}
+	p.SetTargets([]string{"bad resolver"}, []string{"example.com"})
+	if !p.Enabled() {
+		t.Error("expected the prober to be enabled")
+	}
+	probe := p.Run()
+	if len(probe.Lookups) != 1 || !strings.Contains(probe.Lookups[0].Error, "expected system") {
+		t.Errorf("unexpected probe of an invalid resolver %+v", probe)
+	}
+}
@@ -0,0 +1,28 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Prefix : path where the assets of the dashboard are served
+const Prefix = "/static/"
+
+// Body : body of the dashboard page, served by the index handler
+//
+//go:embed static/body.html
+var Body string
+
+//go:embed static
+var files embed.FS
+
+// Assets returns the handler serving the scripts and styles of the
+// dashboard under Prefix
+func Assets() http.Handler {
+	static, err := fs.Sub(files, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(Prefix, http.FileServer(http.FS(static)))
+}
@@ -0,0 +1,178 @@
+// Dashboard of speedtest-monitor, drawn from the versioned API
+(function () {
+  "use strict";
+
+  var refreshInterval = 30000;
+  var svgNS = "http://www.w3.org/2000/svg";
+  var status = {};
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function getJSON(path) {
+    return fetch(path, { headers: { Accept: "application/json" } }).then(function (response) {
+      if (!response.ok) {
+        throw new Error(path + ": " + response.status + " " + response.statusText);
+      }
+      return response.json();
+    });
+  }
+
+  function fixed(value) {
+    return value === undefined || value === null ? "-" : value.toFixed(2);
+  }
+
+  function svg(name, attrs) {
+    var el = document.createElementNS(svgNS, name);
+    Object.keys(attrs || {}).forEach(function (key) {
+      el.setAttribute(key, attrs[key]);
+    });
+    return el;
+  }
+
+  // chart draws the values of the results as a line, skipping the failed
+  // ones, with a dashed line for the threshold if any
+  function chart(el, results, value, threshold) {
+    while (el.firstChild) {
+      el.removeChild(el.firstChild);
+    }
+    var width = el.clientWidth || 400;
+    var height = el.clientHeight || 180;
+    var pad = { left: 40, right: 8, top: 8, bottom: 20 };
+    el.setAttribute("viewBox", "0 0 " + width + " " + height);
+
+    var points = results
+      .filter(function (r) { return r.quality !== "failed"; })
+      .map(function (r) { return { t: new Date(r.timestamp).getTime(), v: value(r), quality: r.quality }; });
+    if (points.length === 0) {
+      var empty = svg("text", { x: width / 2, y: height / 2, "text-anchor": "middle", class: "axis" });
+      empty.textContent = "No results in this range";
+      el.appendChild(empty);
+      return;
+    }
+
+    var t0 = points[0].t, t1 = points[points.length - 1].t;
+    if (t1 === t0) {
+      t0 -= 60000;
+      t1 += 60000;
+    }
+    var max = Math.max.apply(null, points.map(function (p) { return p.v; }).concat([threshold || 0]));
+    max = max > 0 ? max * 1.1 : 1;
+    function x(t) { return pad.left + (t - t0) / (t1 - t0) * (width - pad.left - pad.right); }
+    function y(v) { return height - pad.bottom - v / max * (height - pad.top - pad.bottom); }
+
+    for (var i = 0; i <= 4; i++) {
+      var v = max * i / 4;
+      el.appendChild(svg("line", { x1: pad.left, x2: width - pad.right, y1: y(v), y2: y(v), class: "grid" }));
+      var label = svg("text", { x: pad.left - 4, y: y(v) + 3, "text-anchor": "end", class: "axis" });
+      label.textContent = v >= 100 ? v.toFixed(0) : v.toFixed(1);
+      el.appendChild(label);
+    }
+    [t0, t1].forEach(function (t, i) {
+      var label = svg("text", { x: x(t), y: height - 4, "text-anchor": i === 0 ? "start" : "end", class: "axis" });
+      label.textContent = new Date(t).toLocaleString();
+      el.appendChild(label);
+    });
+
+    if (threshold > 0) {
+      el.appendChild(svg("line", { x1: pad.left, x2: width - pad.right, y1: y(threshold), y2: y(threshold), class: "threshold" }));
+    }
+    el.appendChild(svg("polyline", {
+      class: "line",
+      points: points.map(function (p) { return x(p.t) + "," + y(p.v); }).join(" ")
+    }));
+    points.forEach(function (p) {
+      var point = svg("circle", { cx: x(p.t), cy: y(p.v), r: p.quality === "suspect" ? 3 : 0, class: "point " + p.quality });
+      var title = svg("title");
+      title.textContent = new Date(p.t).toLocaleString() + ": " + fixed(p.v);
+      point.appendChild(title);
+      el.appendChild(point);
+    });
+  }
+
+  function showResults(results) {
+    var latest = results[results.length - 1];
+    if (latest) {
+      $("download").textContent = fixed(latest.downloadBps / 1e6);
+      $("upload").textContent = fixed(latest.uploadBps / 1e6);
+      $("ping").textContent = fixed(latest.pingMs);
+      $("jitter").textContent = fixed(latest.jitterMs);
+    }
+    chart($("chart-download"), results, function (r) { return r.downloadBps / 1e6; }, status.downloadThreshold);
+    chart($("chart-upload"), results, function (r) { return r.uploadBps / 1e6; }, status.uploadThreshold);
+    chart($("chart-ping"), results, function (r) { return r.pingMs; }, status.latencyThreshold);
+  }
+
+  function showStatus() {
+    document.title = status.appName || "speedtest-monitor";
+    $("app-name").textContent = document.title;
+    if (status.testing) {
+      $("status").textContent = "Testing now...";
+    } else if (status.nextTest && new Date(status.nextTest).getTime() > 0) {
+      $("status").textContent = "Next test at " + new Date(status.nextTest).toLocaleString();
+    }
+  }
+
+  function showAlerts(alerts) {
+    var list = $("alerts");
+    list.innerHTML = "";
+    if (alerts.length === 0) {
+      var none = document.createElement("li");
+      none.className = "none";
+      none.textContent = "No alerts";
+      list.appendChild(none);
+      return;
+    }
+    alerts.slice().reverse().forEach(function (alert) {
+      var item = document.createElement("li");
+      var time = document.createElement("time");
+      time.textContent = new Date(alert.time).toLocaleString();
+      item.appendChild(time);
+      item.appendChild(document.createTextNode(alert.message));
+      list.appendChild(item);
+    });
+  }
+
+  function refresh() {
+    var since = $("range").value;
+    return getJSON("/api/v1/status")
+      .then(function (s) {
+        status = s;
+        showStatus();
+        return Promise.all([getJSON("/api/v1/results" + (since ? "?since=" + since : "")), getJSON("/api/v1/alerts")]);
+      })
+      .then(function (data) {
+        showResults(data[0]);
+        showAlerts(data[1]);
+      })
+      .catch(function (err) {
+        $("status").textContent = "Cannot load the data: " + err.message;
+      });
+  }
+
+  function testNow() {
+    var button = $("test-now");
+    button.disabled = true;
+    $("status").textContent = "Testing now...";
+    fetch("/api/v1/tests", { method: "POST" })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.status + " " + response.statusText);
+        }
+        return refresh();
+      })
+      .catch(function (err) {
+        $("status").textContent = "Test failed: " + err.message;
+      })
+      .then(function () {
+        button.disabled = false;
+      });
+  }
+
+  $("range").addEventListener("change", refresh);
+  $("test-now").addEventListener("click", testNow);
+  window.addEventListener("resize", refresh);
+  refresh();
+  setInterval(refresh, refreshInterval);
+})();
@@ -0,0 +1,105 @@
+package endpoint
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits of the requests
+const (
+	// MaxImageSize : largest side of the random images, as requested by
+	// the speedtest.net clients
+	MaxImageSize = 4000
+	// MaxUploadSize : largest upload accepted
+	MaxUploadSize = 64 << 20
+)
+
+// payload is written repeatedly in the random images, random so it can't
+// be compressed on the way
+var payload = func() []byte {
+	p := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(p)
+	return p
+}()
+
+var imagePath = regexp.MustCompile(`/random(\d+)x(\d+)\.jpg$`)
+
+// NewHandler returns the handler of the random{N}x{N}.jpg, upload.php and
+// latency.txt endpoints. They are served under any path, e.g. /upload.php
+// and /speedtest/upload.php, as the clients find the others from the
+// upload.php URL.
+func NewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/latency.txt"):
+			Latency(w, r)
+		case strings.HasSuffix(r.URL.Path, "/upload.php"):
+			Upload(w, r)
+		case imagePath.MatchString(r.URL.Path):
+			Image(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Latency answers the latency requests
+func Latency(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "test=test\n")
+}
+
+// Upload reads the content posted, answering with its size
+func Upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	size, err := io.Copy(ioutil.Discard, http.MaxBytesReader(w, r.Body, MaxUploadSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "size=%d", size)
+}
+
+// Image writes a random image of {N}x{N}, of about the size of the ones
+// of the speedtest.net servers, 2 bytes per pixel
+func Image(w http.ResponseWriter, r *http.Request) {
+	match := imagePath.FindStringSubmatch(r.URL.Path)
+	width, _ := strconv.Atoi(match[1])
+	height, _ := strconv.Atoi(match[2])
+	if width < 1 || height < 1 || width > MaxImageSize || height > MaxImageSize {
+		http.Error(w, fmt.Sprintf("size must be between 1 and %d", MaxImageSize), http.StatusBadRequest)
+		return
+	}
+	size := width * height * 2
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	if r.Method == http.MethodHead {
+		return
+	}
+	for size > 0 {
+		n := len(payload)
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(payload[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	configuration "github.com/speedtest-monitor/app/configuration"
+)
+
+// maxConfigSize : largest request body accepted by PatchConfig
+const maxConfigSize = 1 << 16
+
+// ConfigStore gives access to the configuration of the running service
+type ConfigStore interface {
+	// Config returns the configuration in use
+	Config() *configuration.Configuration
+	// UpdateConfig replaces the configuration in use. keys are the keys
+	// that were changed, to be persisted if enabled.
+	UpdateConfig(conf *configuration.Configuration, keys []string) error
+}
+
+// SetConfigStore sets the store of the configuration changed through the
+// API
+func (h *Handler) SetConfigStore(store ConfigStore) {
+	h.config = store
+}
+
+// authorize checks the bearer token of the request against the apiToken
+// of the configuration, responding with an error if it doesn't match
+func (h *Handler) authorize(ctx context.Context, writer http.ResponseWriter, request *http.Request) bool {
+	token := h.config.Config().APIToken
+	if token == "" {
+		RespondError(ctx, writer, errors.New("the configuration API is disabled, set an apiToken to enable it"), http.StatusForbidden)
+		return false
+	}
+	given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		log.WithFields(log.Fields{
+			"Method": request.Method,
+			"Path":   request.URL.Path,
+			"Remote": request.RemoteAddr,
+		}).Warn("Unauthorized configuration request")
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		RespondError(ctx, writer, errors.New("invalid or missing bearer token"), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// GetConfig returns the configuration in use, with the secrets redacted
+func (h *Handler) GetConfig(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	if !h.authorize(ctx, writer, request) {
+		return nil
+	}
+	log.Debug("Retrieving configuration")
+	Respond(ctx, writer, h.config.Config().Redacted(), http.StatusOK)
+	return nil
+}
+
+// PatchConfig changes the keys of the configuration given in the JSON
+// body, and returns the new configuration with the secrets redacted. Each
+// change is logged.
+func (h *Handler) PatchConfig(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	if !h.authorize(ctx, writer, request) {
+		return nil
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxConfigSize))
+	if err != nil {
+		RespondError(ctx, writer, err, http.StatusBadRequest)
+		return nil
+	}
+
+	current := h.config.Config()
+	patched, keys, err := current.Patch(data)
+	if err != nil {
+		RespondError(ctx, writer, err, http.StatusBadRequest)
+		return nil
+	}
+	changes := configuration.Diff(current, patched)
+	if len(changes) > 0 {
+		if err := h.config.UpdateConfig(patched, keys); err != nil {
+			return err
+		}
+	}
+	for _, change := range changes {
+		log.WithFields(log.Fields{
+			"Action": "config-change",
+			"Key":    change.Key,
+			"Old":    change.Old,
+			"New":    change.New,
+			"Remote": request.RemoteAddr,
+		}).Info("Configuration changed through the API")
+	}
+	Respond(ctx, writer, patched.Redacted(), http.StatusOK)
+	return nil
+}
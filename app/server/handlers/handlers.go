@@ -2,8 +2,15 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"html"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/speedtest-monitor/app/history"
+	"github.com/speedtest-monitor/app/server/dashboard"
 	spt "github.com/speedtest-monitor/app/speedtest"
 	log "github.com/sirupsen/logrus"
 )
@@ -11,18 +18,64 @@ import (
 // Handler is the main struct to reference when calling
 // the handling methods
 type Handler struct {
-	latestResult *spt.LatestResult
-	targets      *spt.Servers
+	tester  *spt.Tester
+	history *history.History
+	probes  *history.Probes
+	config  ConfigStore
+	monitor Monitor
 }
 
-// SetLatestResultPtr sets the pointer to the latest measurement result
-func (h *Handler) SetLatestResultPtr(lr *spt.LatestResult) {
-	h.latestResult = lr
+// Status : state of the periodic tests, served by /api/v1/status.
+// Thresholds are in Mbit/s and milliseconds. The resolver alerts are the
+// ones raised by the latest DNS resolver probe.
+type Status struct {
+	AppName           string    `json:"appName"`
+	IntervalSeconds   int       `json:"intervalSeconds"`
+	NextTest          time.Time `json:"nextTest"`
+	Testing           bool      `json:"testing"`
+	Alerts            []string  `json:"alerts"`
+	DownloadThreshold float64   `json:"downloadThreshold"`
+	UploadThreshold   float64   `json:"uploadThreshold"`
+	LatencyThreshold  float64   `json:"latencyThreshold"`
+	ResolverAlerts    []string  `json:"resolverAlerts"`
+	ResolverThreshold float64   `json:"resolverThreshold"`
 }
 
-// SetTargetServers sets the pointer to the servers to be queried
-func (h *Handler) SetTargetServers(targets *spt.Servers) {
-	h.targets = targets
+// Alert : alert raised by a result or a DNS resolver probe, served by /api/v1/alerts
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Monitor gives the state of the periodic tests
+type Monitor interface {
+	Status() Status
+	// Alerts returns the latest alerts raised, oldest first
+	Alerts() []Alert
+	// TestNow runs a test like the periodic ones, storing its result and
+	// raising its alerts
+	TestNow() spt.Result
+}
+
+// SetMonitor sets the monitor running the periodic tests
+func (h *Handler) SetMonitor(monitor Monitor) {
+	h.monitor = monitor
+}
+
+// SetTester sets the pointer to the tester running the speedtests and
+// keeping the latest measurement result
+func (h *Handler) SetTester(tester *spt.Tester) {
+	h.tester = tester
+}
+
+// SetHistory sets the pointer to the history of results
+func (h *Handler) SetHistory(hist *history.History) {
+	h.history = hist
+}
+
+// SetProbes sets the pointer to the history of DNS resolver probes
+func (h *Handler) SetProbes(probes *history.Probes) {
+	h.probes = probes
 }
 
 // HandlerFunction is the callback function type to be called in each of a
@@ -32,21 +85,128 @@ type HandlerFunction func(context.Context, http.ResponseWriter, *http.Request) e
 // GetLatestResult returns the latest stored speedtest results
 func (h *Handler) GetLatestResult(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 	log.Debug("Retrieving last speedtest results")
-	h.targets.ShowResult(h.latestResult)
-	Respond(ctx, writer, *h.latestResult, http.StatusOK)
+	Respond(ctx, writer, h.tester.Latest().Legacy(), http.StatusOK)
 	return nil
 }
 
 // TestSpeedNow performs a speed test and returns the latest stored speedtest results
 func (h *Handler) TestSpeedNow(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 	log.Debug("Requested to test connection speed")
-	h.targets.TestNow(h.latestResult)
-	Respond(ctx, writer, *h.latestResult, http.StatusOK)
+	result := h.monitor.TestNow()
+	Respond(ctx, writer, result.Legacy(), http.StatusOK)
+	return nil
+}
+
+// GetHistory returns the stored speedtest results, oldest first
+func (h *Handler) GetHistory(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving speedtest results history")
+	results := h.history.Results()
+	legacy := make([]spt.LatestResult, 0, len(results))
+	for _, result := range results {
+		legacy = append(legacy, result.Legacy())
+	}
+	Respond(ctx, writer, legacy, http.StatusOK)
+	return nil
+}
+
+// GetLatestResultV1 returns the latest speedtest result in the versioned format
+func (h *Handler) GetLatestResultV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving last speedtest result")
+	latest := h.tester.Latest()
+	if latest.Timestamp.IsZero() {
+		RespondError(ctx, writer, errors.New("no speedtest has completed yet"), http.StatusNotFound)
+		return nil
+	}
+	Respond(ctx, writer, latest, http.StatusOK)
+	return nil
+}
+
+// GetResultsV1 returns the stored speedtest results in the versioned format,
+// oldest first. The since parameter, a duration like 24h or an RFC 3339
+// time, filters the older results, read from the history file when they
+// are no longer kept in memory.
+func (h *Handler) GetResultsV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving speedtest results history")
+	since, err := parseSince(request.URL.Query().Get("since"))
+	if err != nil {
+		RespondError(ctx, writer, err, http.StatusBadRequest)
+		return nil
+	}
+	Respond(ctx, writer, h.history.Since(since), http.StatusOK)
+	return nil
+}
+
+// parseSince parses the since parameter, a duration like 24h or an RFC
+// 3339 time. It's the zero time if empty.
+func parseSince(param string) (time.Time, error) {
+	if param == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(param); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, param); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, expected a duration or an RFC 3339 time", param)
+}
+
+// TestSpeedNowV1 performs a speed test and returns its result in the
+// versioned format
+func (h *Handler) TestSpeedNowV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Requested to test connection speed")
+	result := h.monitor.TestNow()
+	Respond(ctx, writer, result, http.StatusOK)
+	return nil
+}
+
+// GetLatestProbeV1 returns the latest DNS resolver probe
+func (h *Handler) GetLatestProbeV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving last DNS resolver probe")
+	probes := h.probes.Probes()
+	if len(probes) == 0 {
+		RespondError(ctx, writer, errors.New("no DNS resolver probe has completed yet"), http.StatusNotFound)
+		return nil
+	}
+	Respond(ctx, writer, probes[len(probes)-1], http.StatusOK)
+	return nil
+}
+
+// GetProbesV1 returns the stored DNS resolver probes, oldest first. The
+// since parameter filters the older probes, like in GetResultsV1.
+func (h *Handler) GetProbesV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving DNS resolver probes history")
+	since, err := parseSince(request.URL.Query().Get("since"))
+	if err != nil {
+		RespondError(ctx, writer, err, http.StatusBadRequest)
+		return nil
+	}
+	Respond(ctx, writer, history.FilterProbes(h.probes.Probes(), since), http.StatusOK)
+	return nil
+}
+
+// GetStatusV1 returns the state of the periodic tests: the next scheduled
+// test and the alerts raised by the latest result
+func (h *Handler) GetStatusV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving status")
+	Respond(ctx, writer, h.monitor.Status(), http.StatusOK)
+	return nil
+}
+
+// GetAlertsV1 returns the latest alerts raised, oldest first
+func (h *Handler) GetAlertsV1(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	log.Debug("Retrieving alerts")
+	Respond(ctx, writer, h.monitor.Alerts(), http.StatusOK)
 	return nil
 }
 
-// Index just prints a message, indicating the service is still alive
+// Index serves the dashboard to browsers, and otherwise just prints a
+// message, indicating the service is still alive
 func (h *Handler) Index(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	if strings.Contains(request.Header.Get("Accept"), "text/html") {
+		RespondHTML(writer, html.EscapeString(h.monitor.Status().AppName), dashboard.Body, http.StatusOK)
+		return nil
+	}
 	Respond(ctx, writer, "Internet SpeedTest", http.StatusOK)
 	return nil
 }
@@ -2,6 +2,8 @@ package router
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/speedtest-monitor/app/history"
+	"github.com/speedtest-monitor/app/server/dashboard"
 	"github.com/speedtest-monitor/app/server/handlers"
 	spt "github.com/speedtest-monitor/app/speedtest"
 )
@@ -15,11 +17,14 @@ type Endpoint struct {
 }
 
 // NewRouter creates the routes to listen
-func NewRouter(targets *spt.Servers, maesurementsPtr *spt.LatestResult) *mux.Router {
+func NewRouter(tester *spt.Tester, hist *history.History, probes *history.Probes, store handlers.ConfigStore, monitor handlers.Monitor) *mux.Router {
 
 	handler := &handlers.Handler{}
-	handler.SetLatestResultPtr(maesurementsPtr)
-	handler.SetTargetServers(targets)
+	handler.SetTester(tester)
+	handler.SetHistory(hist)
+	handler.SetProbes(probes)
+	handler.SetConfigStore(store)
+	handler.SetMonitor(monitor)
 
 	var endpoints = []Endpoint{
 		{
@@ -40,6 +45,66 @@ func NewRouter(targets *spt.Servers, maesurementsPtr *spt.LatestResult) *mux.Rou
 			"/testSpeedNow",
 			handler.TestSpeedNow,
 		},
+		{
+			"GetHistory",
+			"GET",
+			"/getHistory",
+			handler.GetHistory,
+		},
+		{
+			"GetLatestResultV1",
+			"GET",
+			"/api/v1/results/latest",
+			handler.GetLatestResultV1,
+		},
+		{
+			"GetResultsV1",
+			"GET",
+			"/api/v1/results",
+			handler.GetResultsV1,
+		},
+		{
+			"TestSpeedNowV1",
+			"POST",
+			"/api/v1/tests",
+			handler.TestSpeedNowV1,
+		},
+		{
+			"GetStatusV1",
+			"GET",
+			"/api/v1/status",
+			handler.GetStatusV1,
+		},
+		{
+			"GetAlertsV1",
+			"GET",
+			"/api/v1/alerts",
+			handler.GetAlertsV1,
+		},
+		{
+			"GetLatestProbeV1",
+			"GET",
+			"/api/v1/resolvers/latest",
+			handler.GetLatestProbeV1,
+		},
+		{
+			"GetProbesV1",
+			"GET",
+			"/api/v1/resolvers",
+			handler.GetProbesV1,
+		},
+		{
+			"GetConfig",
+			"GET",
+			"/api/v1/config",
+			handler.GetConfig,
+		},
+		{
+			"PatchConfig",
+			"PATCH",
+			"/api/v1/config",
+			handler.PatchConfig,
+		},
 	}
 
 	router := mux.NewRouter().StrictSlash(true)
@@ -50,6 +115,11 @@ func NewRouter(targets *spt.Servers, maesurementsPtr *spt.LatestResult) *mux.Rou
 			Name(endpoint.Name).
 			Handler(endpoint.HandlerFunc)
 	}
+	router.
+		Methods("GET").
+		PathPrefix(dashboard.Prefix).
+		Name("Dashboard").
+		Handler(dashboard.Assets())
 
 	return router
 
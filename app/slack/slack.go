@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/speedtest-monitor/app/configuration"
 	log "github.com/sirupsen/logrus"
@@ -74,10 +75,14 @@ func (sc *SlackClient) SendMessages() {
 	response, err := http.Post(sc.Endpoint, "application/json", bytes.NewBuffer(jsonData))
 
 	sc.Messages = nil
-	log.Debugf("Slack response status code: %d", response.StatusCode)
 	if err != nil {
+		// The error of the request includes the webhook URL, which is a secret
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
 		log.Errorf("Error while sending Slack message: %s", err)
 	} else {
+		log.Debugf("Slack response status code: %d", response.StatusCode)
 		defer response.Body.Close()
 		data, _ := ioutil.ReadAll(response.Body)
 		log.Debug(string(data))
@@ -0,0 +1,56 @@
+package speedtest
+
+import "sort"
+
+// Aggregate functions, combining the measurements of multiple servers
+const (
+	AggregateMean   = "mean"
+	AggregateMedian = "median"
+	AggregateMax    = "max"
+)
+
+// Aggregates lists the valid aggregate functions
+var Aggregates = []string{AggregateMean, AggregateMedian, AggregateMax}
+
+// aggregateLabels : labels used in the result strings of each aggregate function
+var aggregateLabels = map[string]string{
+	AggregateMean:   "Avg",
+	AggregateMedian: "Median",
+	AggregateMax:    "Max",
+}
+
+// aggregate combines the values with the given function. The mean is used
+// if the function is unknown.
+func aggregate(fn string, values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	switch fn {
+	case AggregateMedian:
+		return median(values)
+	case AggregateMax:
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	default:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,130 @@
+package speedtest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackendSpeedtest : name of the backend speaking the legacy speedtest.net
+// HTTP protocol, used when none is configured
+const BackendSpeedtest = "speedtest"
+
+// Backend : provider of the servers and of the protocol used to measure
+// the connection against them. The scheduling, validation and storage of
+// the results are the same for every backend.
+type Backend interface {
+	// Name returns the name of the backend, as set in the configuration
+	Name() string
+	// Servers returns the servers available to the client, nearest first
+	Servers(client User) (ServerList, error)
+	// Ping returns the latency and jitter to the server
+	Ping(s Server) (latency time.Duration, jitter time.Duration, err error)
+	// Download measures the download speed from the server, adding the
+	// bytes received to count as they arrive
+	Download(s Server, latency time.Duration, count *int64) (Measurement, error)
+	// Upload measures the upload speed to the server, adding the bytes
+	// sent to count as they leave
+	Upload(s Server, latency time.Duration, count *int64) (Measurement, error)
+}
+
+// ClientReporter : implemented by the backends whose servers report the
+// IP and ISP of the client, as seen by them
+type ClientReporter interface {
+	Client(s Server) (User, error)
+}
+
+// Measurement : result of a download or upload test. Speed is in Mbit/s,
+// WarmUpOnly is set when the connection was too slow for the full test.
+type Measurement struct {
+	Speed      float64
+	WarmUpOnly bool
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{}
+)
+
+// RegisterBackend makes a backend available under its name, replacing any
+// backend registered with the same name
+func RegisterBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[b.Name()] = b
+}
+
+// BackendNames returns the names of the registered backends, sorted
+func BackendNames() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetBackend returns the backend registered with the name, the speedtest
+// one if name is empty
+func GetBackend(name string) (Backend, error) {
+	if name == "" {
+		name = BackendSpeedtest
+	}
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	return b, nil
+}
+
+// FetchServers retrieves the servers available to the client from the
+// named backend, nearest first. The servers are tested with that backend.
+func FetchServers(backend string, user User) (ServerList, error) {
+	b, err := GetBackend(backend)
+	if err != nil {
+		return ServerList{}, err
+	}
+	list, err := b.Servers(user)
+	if err != nil {
+		return ServerList{}, fmt.Errorf("cannot fetch the servers of the %s backend: %s", b.Name(), err)
+	}
+	if len(list.Servers) == 0 {
+		return ServerList{}, fmt.Errorf("no servers available from the %s backend", b.Name())
+	}
+	for i := range list.Servers {
+		list.Servers[i].Backend = b.Name()
+	}
+	return list, nil
+}
+
+// ReportedClient returns the client with the IP and ISP reported by the
+// nearest server of the list, if its backend supports it. The location of
+// the client is kept.
+func (l ServerList) ReportedClient(client User) User {
+	if len(l.Servers) == 0 {
+		return client
+	}
+	s := l.Servers[0]
+	b, err := GetBackend(s.Backend)
+	if err != nil {
+		return client
+	}
+	reporter, ok := b.(ClientReporter)
+	if !ok {
+		return client
+	}
+	reported, err := reporter.Client(s)
+	if err != nil {
+		log.Warnf("Cannot fetch the client information from server [%s]: %s", s.ID, err)
+		return client
+	}
+	client.IP, client.Isp = reported.IP, reported.Isp
+	return client
+}
@@ -0,0 +1,113 @@
+package speedtest
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackendHTTP : name of the backend testing against any HTTP server
+const BackendHTTP = "http"
+
+// BytesPlaceholder : placeholder of the download URL of the http backend,
+// replaced with the size of each request in bytes
+const BytesPlaceholder = "{bytes}"
+
+// HTTP : backend measuring the throughput to any HTTP server, e.g. a CDN
+// or an object storage, with the warm up and parallel requests of the
+// speedtest.net tests
+type HTTP struct {
+	// DownloadURL : URL of the downloads, with BytesPlaceholder in place
+	// of the size requested if the server supports it
+	DownloadURL string
+	// UploadURL : URL where the uploads are POSTed
+	UploadURL string
+	// PingURL : URL of a small endpoint to measure the latency, the
+	// download URL for 0 bytes if empty
+	PingURL string
+	// PingMethod : method of the latency requests, HEAD if empty
+	PingMethod string
+}
+
+func init() {
+	RegisterBackend(HTTP{})
+}
+
+// Name returns the name of the backend
+func (HTTP) Name() string {
+	return BackendHTTP
+}
+
+// Servers returns the server of the download URL
+func (b HTTP) Servers(client User) (ServerList, error) {
+	if b.DownloadURL == "" || b.UploadURL == "" {
+		return ServerList{}, errors.New("the download and upload URLs are not configured")
+	}
+	u, err := url.Parse(b.downloadURL(0))
+	if err != nil {
+		return ServerList{}, err
+	}
+	return ServerList{Servers: []Server{{
+		URL:  b.DownloadURL,
+		Name: u.Host,
+		ID:   "1",
+		Host: u.Host,
+	}}}, nil
+}
+
+// downloadURL returns the URL to download size bytes
+func (b HTTP) downloadURL(size int) string {
+	return strings.Replace(b.DownloadURL, BytesPlaceholder, strconv.Itoa(size), -1)
+}
+
+// requests returns the requests of the tests. The sizes are those of the
+// speedtest.net requests, from about 0.25 MB to 32 MB for downloads and
+// 100 kB to 4 MB for uploads.
+func (b HTTP) requests() httpRequests {
+	return httpRequests{
+		downloadURL: func(w int) string {
+			return b.downloadURL(dlSizes[w] * dlSizes[w] * 2)
+		},
+		uploadURL: b.UploadURL,
+		uploadContent: func(w int) []byte {
+			return randomPayload()[:ulSizes[w]*1000]
+		},
+		contentType: "application/octet-stream",
+	}
+}
+
+// ping returns the method and URL of the latency requests
+func (b HTTP) ping() (string, string) {
+	pingURL, method := b.PingURL, b.PingMethod
+	if pingURL == "" {
+		pingURL = b.downloadURL(0)
+	}
+	if method == "" {
+		method = "HEAD"
+	}
+	return method, pingURL
+}
+
+// Ping returns the latency and jitter to the ping URL
+func (b HTTP) Ping(s Server) (time.Duration, time.Duration, error) {
+	latency, jitter, _, err := b.TracePing(s)
+	return latency, jitter, err
+}
+
+// TracePing returns the latency and jitter to the ping URL, and the
+// timings of the first request
+func (b HTTP) TracePing(s Server) (time.Duration, time.Duration, Timings, error) {
+	return measureLatency(b.ping())
+}
+
+// Download measures the download speed from the download URL
+func (b HTTP) Download(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	return downloadTest(b.requests(), latency, count)
+}
+
+// Upload measures the upload speed to the upload URL
+func (b HTTP) Upload(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	return uploadTest(b.requests(), latency, count)
+}
@@ -0,0 +1,122 @@
+package speedtest
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeStorage : HTTP server serving downloads of the size given by the
+// bytes parameter, and accepting uploads, recording the requests
+type fakeStorage struct {
+	mu       sync.Mutex
+	sizes    map[int]int
+	methods  map[string]int
+	uploaded int64
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.methods[r.Method+" "+r.URL.Path]++
+	f.mu.Unlock()
+	switch r.URL.Path {
+	case "/download":
+		size, err := strconv.Atoi(r.URL.Query().Get("bytes"))
+		if err != nil {
+			http.Error(w, "bad size", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.sizes[size]++
+		f.mu.Unlock()
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		if r.Method != http.MethodHead {
+			w.Write(make([]byte, size))
+		}
+	case "/upload":
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt64(&f.uploaded, n)
+	case "/ping":
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestHTTPServers(t *testing.T) {
+	if _, err := (HTTP{DownloadURL: "http://cdn.example.com/file"}).Servers(User{}); err == nil {
+		t.Error("expected an error without upload URL")
+	}
+	list, err := HTTP{DownloadURL: "http://cdn.example.com/file?bytes={bytes}", UploadURL: "http://store.example.com/"}.Servers(User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Servers) != 1 || list.Servers[0].ID != "1" || list.Servers[0].Host != "cdn.example.com" {
+		t.Errorf("unexpected servers %+v", list.Servers)
+	}
+}
+
+func TestHTTPBackend(t *testing.T) {
+	storage := &fakeStorage{sizes: map[int]int{}, methods: map[string]int{}}
+	server := startServer(t, storage)
+	b := HTTP{DownloadURL: server.URL + "/download?bytes={bytes}", UploadURL: server.URL + "/upload"}
+	s := Server{ID: "1"}
+
+	// The latency is measured with HEAD requests of 0 bytes by default
+	latency, _, timings, err := b.TracePing(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 || timings.TTFB <= 0 || storage.methods["HEAD /download"] != pingCount+1 || storage.sizes[0] != pingCount+1 {
+		t.Errorf("unexpected latency %v, timings %+v and requests %v", latency, timings, storage.methods)
+	}
+
+	var received int64
+	dl, err := b.Download(s, latency, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sizes are those of the images of the speedtest.net servers
+	if storage.sizes[750*750*2] != 2 || storage.sizes[1500*1500*2] != 16 || dl.WarmUpOnly || dl.Speed <= 0 {
+		t.Errorf("got a download of %f Mbps, with the sizes %v", dl.Speed, storage.sizes)
+	}
+	if want := int64(2*750*750*2 + 16*1500*1500*2); received != want {
+		t.Errorf("received %d bytes, want %d", received, want)
+	}
+
+	var sent int64
+	ul, err := b.Upload(s, latency, &sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The warm up uploads 2 requests of 1 MB, and the test 16 of 4 MB
+	if want := int64(2*1000*1000 + 16*4000*1000); sent != want || atomic.LoadInt64(&storage.uploaded) != want || ul.Speed <= 0 {
+		t.Errorf("got an upload of %f Mbps, %d bytes sent and %d received, want %d", ul.Speed, sent, storage.uploaded, want)
+	}
+
+	b.PingURL, b.PingMethod = server.URL+"/ping", "GET"
+	if _, _, err := b.Ping(s); err != nil {
+		t.Fatal(err)
+	}
+	if n := storage.methods["GET /ping"]; n != pingCount+1 {
+		t.Errorf("got %d GET requests to the ping URL, want %d", n, pingCount+1)
+	}
+}
+
+func TestHTTPServerError(t *testing.T) {
+	storage := &fakeStorage{sizes: map[int]int{}, methods: map[string]int{}}
+	server := startServer(t, storage)
+	b := HTTP{DownloadURL: server.URL + "/missing", UploadURL: server.URL + "/missing"}
+
+	var count int64
+	if _, err := b.Download(Server{}, 0, &count); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got the download error %v, want a 404", err)
+	}
+	if _, err := b.Upload(Server{}, 0, &count); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got the upload error %v, want a 404", err)
+	}
+}
@@ -0,0 +1,525 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackendIperf3 : name of the backend speaking the iperf3 protocol
+const BackendIperf3 = "iperf3"
+
+// Settings of the iperf3 tests
+const (
+	// iperf3Port : default port of the iperf3 servers
+	iperf3Port = "5201"
+	// iperf3Duration : time of each download and upload test
+	iperf3Duration = 10 * time.Second
+	// iperf3Streams : number of parallel TCP streams
+	iperf3Streams = 4
+	// iperf3BlockSize : size of each write of the sender
+	iperf3BlockSize = 128 * 1024
+	// iperf3Timeout : time to wait for each message of the server
+	iperf3Timeout = 30 * time.Second
+	// iperf3Version : version of iperf3 reported to the server
+	iperf3Version = "3.1.3"
+	// iperf3MaxMessage : largest JSON message accepted from the server
+	iperf3MaxMessage = 1 << 20
+)
+
+// States of an iperf3 test, sent as a single byte on the control connection
+const (
+	iperf3TestStart       = 1
+	iperf3TestRunning     = 2
+	iperf3TestEnd         = 4
+	iperf3ParamExchange   = 9
+	iperf3CreateStreams   = 10
+	iperf3ServerTerminate = 11
+	iperf3ExchangeResults = 13
+	iperf3DisplayResults  = 14
+	iperf3Done            = 16
+	iperf3AccessDenied    = -1
+	iperf3ServerError     = -2
+)
+
+// iperf3CookieChars : characters of the cookie identifying a test
+const iperf3CookieChars = "abcdefghijklmnopqrstuvwxyz234567"
+
+// Iperf3 : backend testing the throughput against iperf3 servers, for the
+// links where no speedtest server exists. There is no discovery, the
+// servers are given in Addresses, as host[:port].
+type Iperf3 struct {
+	Addresses []string
+}
+
+// iperf3Params : parameters of a test, sent to the server
+type iperf3Params struct {
+	TCP           bool   `json:"tcp"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Len           int    `json:"len"`
+	ClientVersion string `json:"client_version"`
+}
+
+// iperf3Results : results exchanged at the end of a test
+type iperf3Results struct {
+	CPUUtilTotal         float64              `json:"cpu_util_total"`
+	CPUUtilUser          float64              `json:"cpu_util_user"`
+	CPUUtilSystem        float64              `json:"cpu_util_system"`
+	SenderHasRetransmits int                  `json:"sender_has_retransmits"`
+	Streams              []iperf3StreamResult `json:"streams"`
+}
+
+// iperf3StreamResult : results of a single stream. Times are in seconds.
+type iperf3StreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int     `json:"errors"`
+	Packets     int     `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+func init() {
+	RegisterBackend(Iperf3{})
+}
+
+// Name returns the name of the backend
+func (Iperf3) Name() string {
+	return BackendIperf3
+}
+
+// Servers returns the configured servers, in order, numbered from 1
+func (b Iperf3) Servers(client User) (ServerList, error) {
+	servers := Servers{}
+	for i, address := range b.Addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			host, port = address, iperf3Port
+		}
+		if host == "" {
+			return ServerList{}, fmt.Errorf("invalid iperf3 server %q", address)
+		}
+		hostPort := net.JoinHostPort(host, port)
+		servers = append(servers, Server{
+			URL:  "iperf3://" + hostPort,
+			Name: hostPort,
+			ID:   strconv.Itoa(i + 1),
+			Host: hostPort,
+		})
+	}
+	return ServerList{Servers: servers}, nil
+}
+
+// Ping returns the latency and jitter to the server, see TracePing
+func (b Iperf3) Ping(s Server) (time.Duration, time.Duration, error) {
+	latency, jitter, _, err := b.TracePing(s)
+	return latency, jitter, err
+}
+
+// TracePing opens the control connection of the next test, which is kept
+// for it, instead of opening others the server would log as errors. The
+// latency and jitter are measured from the time to connect and the round
+// trip of the cookie, and the TTFB is the time to the first state sent by
+// the server. There is no TLS.
+func (Iperf3) TracePing(s Server) (time.Duration, time.Duration, Timings, error) {
+	session, samples, timings, err := iperf3Open(s.Host)
+	if err != nil {
+		return 0, 0, Timings{}, err
+	}
+	iperf3Sessions.keep(s.Host, session)
+	l, jitter := latencyOf(samples)
+	log.Infof("Latency: %v, Jitter: %v", l, jitter)
+	return l, jitter, timings, nil
+}
+
+// Download measures the throughput of the server sending to the client,
+// in the reverse mode of iperf3
+func (Iperf3) Download(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	log.Debug("Running Download Test")
+	return iperf3Test(s.Host, true, count)
+}
+
+// Upload measures the throughput of the client sending to the server
+func (Iperf3) Upload(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	log.Debug("Running Upload Test")
+	return iperf3Test(s.Host, false, count)
+}
+
+// iperf3Session : control connection of a test, with the first state sent
+// by the server once it read the cookie
+type iperf3Session struct {
+	conn   net.Conn
+	cookie []byte
+	state  int8
+}
+
+// iperf3State : state read from the control connection
+type iperf3State struct {
+	state int8
+	err   error
+}
+
+// iperf3Pending : sessions opened by TracePing, by address, waiting for
+// their test
+type iperf3Pending struct {
+	mu       sync.Mutex
+	sessions map[string]*iperf3Session
+}
+
+var iperf3Sessions = &iperf3Pending{sessions: map[string]*iperf3Session{}}
+
+// keep stores the session for the next test of the address, closing the
+// one stored before if it was never used
+func (p *iperf3Pending) keep(address string, session *iperf3Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.sessions[address]; ok {
+		old.conn.Close()
+	}
+	p.sessions[address] = session
+}
+
+// take returns the session stored for the address, if any, removing it
+func (p *iperf3Pending) take(address string) *iperf3Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	session := p.sessions[address]
+	delete(p.sessions, address)
+	return session
+}
+
+// iperf3Open opens the control connection of a test and sends the cookie,
+// timing each step. The samples are the time to connect and the round trip
+// of the cookie.
+func iperf3Open(address string) (*iperf3Session, []time.Duration, Timings, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, nil, Timings{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), iperf3Timeout)
+	defer cancel()
+
+	timings := Timings{}
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, nil, Timings{}, err
+	}
+	timings.DNS = time.Since(start)
+
+	connectStart := time.Now()
+	dialer := net.Dialer{}
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, Timings{}, err
+	}
+	timings.Connect = time.Since(connectStart)
+
+	session := &iperf3Session{conn: conn, cookie: iperf3Cookie()}
+	cookieStart := time.Now()
+	if err := session.write(session.cookie); err != nil {
+		conn.Close()
+		return nil, nil, Timings{}, err
+	}
+	if session.state, err = session.readState(); err != nil {
+		conn.Close()
+		return nil, nil, Timings{}, err
+	}
+	timings.TTFB = time.Since(start)
+	return session, []time.Duration{timings.Connect, time.Since(cookieStart)}, timings, nil
+}
+
+// iperf3Test runs a test against the server at address, counting the
+// bytes moved by the client, on the session opened by TracePing if any.
+// The speed is taken from the bytes received, as reported by the server
+// for uploads.
+func iperf3Test(address string, reverse bool, count *int64) (Measurement, error) {
+	session := iperf3Sessions.take(address)
+	if session == nil {
+		var err error
+		if session, _, _, err = iperf3Open(address); err != nil {
+			return Measurement{}, err
+		}
+	}
+	conn := session.conn
+	streams := []net.Conn{}
+	wg := new(sync.WaitGroup)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopStreams := func() {
+		stopOnce.Do(func() { close(stop) })
+	}
+	// No stream must count bytes once the test returns
+	defer func() {
+		stopStreams()
+		for _, stream := range streams {
+			stream.Close()
+		}
+		wg.Wait()
+		conn.Close()
+	}()
+
+	var start time.Time
+	var elapsed time.Duration
+	var received int64
+	results := iperf3Results{}
+	next := session.readState
+	state := session.state
+	for {
+		var err error
+		switch state {
+		case iperf3ParamExchange:
+			err = session.writeJSON(iperf3Params{
+				TCP:           true,
+				Time:          int(iperf3Duration / time.Second),
+				Parallel:      iperf3Streams,
+				Reverse:       reverse,
+				Len:           iperf3BlockSize,
+				ClientVersion: iperf3Version,
+			})
+		case iperf3CreateStreams:
+			for i := 0; i < iperf3Streams && err == nil; i++ {
+				var stream net.Conn
+				stream, err = net.DialTimeout("tcp", address, iperf3Timeout)
+				if err == nil {
+					streams = append(streams, stream)
+					_, err = stream.Write(session.cookie)
+				}
+			}
+		case iperf3TestStart:
+		case iperf3TestRunning:
+			start = time.Now()
+			for _, stream := range streams {
+				wg.Add(1)
+				if reverse {
+					go iperf3Receive(wg, stream, count)
+				} else {
+					go iperf3Send(wg, stream, count, stop)
+				}
+			}
+			// The server can end the test early, e.g. when it's terminated,
+			// so its next state is read while the test runs
+			states := make(chan iperf3State, 1)
+			go func() {
+				state, err := session.readState()
+				states <- iperf3State{state, err}
+			}()
+			timer := time.NewTimer(iperf3Duration)
+			finished := false
+			select {
+			case <-timer.C:
+				finished = true
+			case s := <-states:
+				timer.Stop()
+				states <- s
+			}
+			next = func() (int8, error) {
+				s := <-states
+				next = session.readState
+				return s.state, s.err
+			}
+			if !reverse {
+				stopStreams()
+				wg.Wait()
+			}
+			elapsed, received = time.Since(start), atomic.LoadInt64(count)
+			if finished {
+				err = session.write([]byte{iperf3TestEnd})
+			}
+		case iperf3ExchangeResults:
+			err = session.writeJSON(iperf3ClientResults(len(streams), received, elapsed))
+			if err == nil {
+				err = session.readJSON(&results)
+			}
+		case iperf3DisplayResults:
+			if err := session.write([]byte{iperf3Done}); err != nil {
+				log.Debugf("Cannot end the iperf3 test: %s", err)
+			}
+			return iperf3Measurement(reverse, received, elapsed, results)
+		case iperf3ServerTerminate:
+			return Measurement{}, fmt.Errorf("the iperf3 server terminated the test")
+		case iperf3AccessDenied:
+			return Measurement{}, fmt.Errorf("the iperf3 server is busy running a test")
+		case iperf3ServerError:
+			return Measurement{}, session.readError()
+		default:
+			return Measurement{}, fmt.Errorf("unexpected iperf3 state %d", state)
+		}
+		if err != nil {
+			return Measurement{}, err
+		}
+		if state, err = next(); err != nil {
+			return Measurement{}, err
+		}
+	}
+}
+
+// iperf3Measurement returns the speed of a test, from the bytes received
+// by the client for downloads, and by the server for uploads
+func iperf3Measurement(reverse bool, received int64, elapsed time.Duration, results iperf3Results) (Measurement, error) {
+	seconds := elapsed.Seconds()
+	if !reverse {
+		received = 0
+		for _, stream := range results.Streams {
+			received += stream.Bytes
+			if stream.EndTime-stream.StartTime > 0 {
+				seconds = stream.EndTime - stream.StartTime
+			}
+		}
+	}
+	if received <= 0 {
+		return Measurement{}, fmt.Errorf("no data was transferred")
+	}
+	return Measurement{Speed: float64(received) * 8 / 1e6 / seconds}, nil
+}
+
+// iperf3Send writes blocks to the stream until stop is closed
+func iperf3Send(wg *sync.WaitGroup, stream net.Conn, count *int64, stop chan struct{}) {
+	defer wg.Done()
+	block := make([]byte, iperf3BlockSize)
+	rand.Read(block)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		stream.SetWriteDeadline(time.Now().Add(progressInterval))
+		n, err := stream.Write(block)
+		atomic.AddInt64(count, int64(n))
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			checkError(err)
+			return
+		}
+	}
+}
+
+// iperf3Receive reads the stream until it's closed, counting the bytes
+// received
+func iperf3Receive(wg *sync.WaitGroup, stream net.Conn, count *int64) {
+	defer wg.Done()
+	buffer := make([]byte, iperf3BlockSize)
+	for {
+		n, err := stream.Read(buffer)
+		atomic.AddInt64(count, int64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// iperf3ClientResults returns the results of the client, splitting the
+// bytes moved evenly among the streams, as they aren't counted per stream
+func iperf3ClientResults(streams int, bytes int64, elapsed time.Duration) iperf3Results {
+	results := iperf3Results{SenderHasRetransmits: -1, Streams: []iperf3StreamResult{}}
+	for i := 0; i < streams; i++ {
+		results.Streams = append(results.Streams, iperf3StreamResult{
+			ID:          iperf3StreamID(i),
+			Bytes:       bytes / int64(streams),
+			Retransmits: -1,
+			EndTime:     elapsed.Seconds(),
+		})
+	}
+	return results
+}
+
+// iperf3StreamID returns the ID given by iperf3 to the i-th stream: 1 to
+// the first one, and from 3 on to the others
+func iperf3StreamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+// iperf3Cookie returns a random cookie, 36 characters and a NUL
+func iperf3Cookie() []byte {
+	cookie := make([]byte, 37)
+	rand.Read(cookie[:36])
+	for i := 0; i < 36; i++ {
+		cookie[i] = iperf3CookieChars[int(cookie[i])%len(iperf3CookieChars)]
+	}
+	return cookie
+}
+
+func (session *iperf3Session) write(data []byte) error {
+	session.conn.SetWriteDeadline(time.Now().Add(iperf3Timeout))
+	_, err := session.conn.Write(data)
+	return err
+}
+
+// readState reads a state sent by the server
+func (session *iperf3Session) readState() (int8, error) {
+	// The test runs on the other connections, leave room for it
+	session.conn.SetReadDeadline(time.Now().Add(iperf3Duration + iperf3Timeout))
+	state := make([]byte, 1)
+	if _, err := io.ReadFull(session.conn, state); err != nil {
+		return 0, fmt.Errorf("cannot read the state of the iperf3 server: %s", err)
+	}
+	return int8(state[0]), nil
+}
+
+// writeJSON sends a JSON message, preceded by its length
+func (session *iperf3Session) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	message := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(message, uint32(len(data)))
+	copy(message[4:], data)
+	return session.write(message)
+}
+
+// readJSON reads a JSON message, preceded by its length
+func (session *iperf3Session) readJSON(v interface{}) error {
+	session.conn.SetReadDeadline(time.Now().Add(iperf3Timeout))
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(session.conn, size); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(size)
+	if length > iperf3MaxMessage {
+		return fmt.Errorf("the iperf3 server sent a message of %d bytes, more than %d", length, iperf3MaxMessage)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(session.conn, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readError reads the error codes sent by the server with its error state
+func (session *iperf3Session) readError() error {
+	session.conn.SetReadDeadline(time.Now().Add(iperf3Timeout))
+	codes := make([]byte, 8)
+	if _, err := io.ReadFull(session.conn, codes); err != nil {
+		return fmt.Errorf("the iperf3 server failed")
+	}
+	return fmt.Errorf("the iperf3 server failed with error %d (errno %d)",
+		int32(binary.BigEndian.Uint32(codes)), int32(binary.BigEndian.Uint32(codes[4:])))
+}
@@ -0,0 +1,250 @@
+package speedtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeIperf3 : iperf3 server running a single test, sending results as the
+// JSON message of its results, or the state given instead of
+// ExchangeResults
+type fakeIperf3 struct {
+	listener    net.Listener
+	results     []byte
+	state       int8
+	connections int32
+	params      iperf3Params
+	errors      chan error
+}
+
+// startIperf3 starts a fake iperf3 server sending the results given
+func startIperf3(t *testing.T, results []byte, state int8) *fakeIperf3 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeIperf3{listener: listener, results: results, state: state, errors: make(chan error, 1)}
+	go func() {
+		server.errors <- server.serve()
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (f *fakeIperf3) address() string {
+	return f.listener.Addr().String()
+}
+
+// wait returns the error of the server, once its test ended
+func (f *fakeIperf3) wait(t *testing.T) {
+	select {
+	case err := <-f.errors:
+		if err != nil {
+			t.Fatalf("fake iperf3 server: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fake iperf3 server is still running")
+	}
+}
+
+func (f *fakeIperf3) accept() (net.Conn, []byte, error) {
+	conn, err := f.listener.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	atomic.AddInt32(&f.connections, 1)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	cookie := make([]byte, 37)
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("cannot read the cookie: %s", err)
+	}
+	return conn, cookie, nil
+}
+
+func (f *fakeIperf3) serve() error {
+	control, cookie, err := f.accept()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	if cookie[36] != 0 || bytes.IndexByte(cookie[:36], 0) >= 0 {
+		return fmt.Errorf("invalid cookie %q", cookie)
+	}
+	if f.state != iperf3ExchangeResults {
+		_, err := control.Write([]byte{byte(f.state)})
+		return err
+	}
+
+	control.Write([]byte{iperf3ParamExchange})
+	if err := readMessage(control, &f.params); err != nil {
+		return err
+	}
+	control.Write([]byte{iperf3CreateStreams})
+	streams := []net.Conn{}
+	defer func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
+	for i := 0; i < f.params.Parallel; i++ {
+		stream, streamCookie, err := f.accept()
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+		if !bytes.Equal(streamCookie, cookie) {
+			return fmt.Errorf("stream %d sent the cookie %q, want %q", i, streamCookie, cookie)
+		}
+	}
+	control.Write([]byte{iperf3TestStart, iperf3TestRunning})
+
+	// The test ends as soon as the data is moved, without waiting for the
+	// client to end it
+	block := make([]byte, f.params.Len)
+	for _, stream := range streams {
+		if f.params.Reverse {
+			stream.Write(block)
+			stream.Close()
+		} else {
+			go io.Copy(ioutil.Discard, stream)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	control.Write([]byte{iperf3ExchangeResults})
+	var client iperf3Results
+	if err := readMessage(control, &client); err != nil {
+		return err
+	}
+	if len(client.Streams) != f.params.Parallel {
+		return fmt.Errorf("got the results of %d streams, want %d", len(client.Streams), f.params.Parallel)
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(f.results)))
+	control.Write(append(size, f.results...))
+	control.Write([]byte{iperf3DisplayResults})
+	done := make([]byte, 1)
+	io.ReadFull(control, done)
+	return nil
+}
+
+// readMessage reads a JSON message preceded by its length
+func readMessage(conn net.Conn, v interface{}) error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// serverResults returns the results of a server that received bytes on
+// each of 4 streams in a second
+func serverResults(t *testing.T, bytes int64) []byte {
+	results := iperf3Results{}
+	for i := 0; i < iperf3Streams; i++ {
+		results.Streams = append(results.Streams, iperf3StreamResult{
+			ID:      iperf3StreamID(i),
+			Bytes:   bytes,
+			EndTime: 1,
+		})
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestIperf3Download(t *testing.T) {
+	server := startIperf3(t, serverResults(t, 0), iperf3ExchangeResults)
+	s := Server{Host: server.address()}
+
+	latency, _, timings, err := Iperf3{}.TracePing(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 || timings.Connect <= 0 || timings.TTFB < timings.Connect {
+		t.Errorf("unexpected latency %v and timings %+v", latency, timings)
+	}
+	var count int64
+	m, err := Iperf3{}.Download(s, latency, &count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.wait(t)
+
+	if !server.params.Reverse || !server.params.TCP || server.params.Parallel != iperf3Streams || server.params.Len != iperf3BlockSize {
+		t.Errorf("unexpected parameters %+v", server.params)
+	}
+	if count != iperf3Streams*iperf3BlockSize {
+		t.Errorf("got %d bytes, want %d", count, iperf3Streams*iperf3BlockSize)
+	}
+	if m.Speed <= 0 {
+		t.Errorf("got a speed of %f", m.Speed)
+	}
+	// The ping is measured on the control connection of the test
+	if n := atomic.LoadInt32(&server.connections); n != 1+iperf3Streams {
+		t.Errorf("got %d connections, want %d", n, 1+iperf3Streams)
+	}
+}
+
+func TestIperf3Upload(t *testing.T) {
+	server := startIperf3(t, serverResults(t, 1250000), iperf3ExchangeResults)
+
+	start := time.Now()
+	var count int64
+	m, err := Iperf3{}.Upload(Server{Host: server.address()}, 0, &count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.wait(t)
+
+	if server.params.Reverse {
+		t.Error("the upload was run in reverse mode")
+	}
+	if elapsed := time.Since(start); elapsed >= iperf3Duration {
+		t.Errorf("the upload took %v after the server ended it", elapsed)
+	}
+	// 4 streams of 1.25 MB in a second, as reported by the server
+	if m.Speed != 40 {
+		t.Errorf("got a speed of %f Mbps, want 40", m.Speed)
+	}
+}
+
+func TestIperf3Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []byte
+		state   int8
+		err     string
+	}{
+		{"busy", nil, iperf3AccessDenied, "busy"},
+		{"terminated", nil, iperf3ServerTerminate, "terminated"},
+		{"garbled", []byte("{not json"), iperf3ExchangeResults, "invalid character"},
+		{"oversized", make([]byte, iperf3MaxMessage+1), iperf3ExchangeResults, "more than"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startIperf3(t, test.results, test.state)
+			var count int64
+			_, err := Iperf3{}.Upload(Server{Host: server.address()}, 0, &count)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got the error %v, want %q", err, test.err)
+			}
+			server.wait(t)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package speedtest
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Legacy : the speedtest.net servers, measured through their
+// random{N}x{N}.jpg, upload.php and latency.txt HTTP endpoints. If URLs is
+// set, the servers at those URLs are tested instead, e.g. instances of the
+// serve-endpoint command.
+type Legacy struct {
+	URLs []string
+}
+
+func init() {
+	RegisterBackend(Legacy{})
+}
+
+// Name returns the name of the backend
+func (Legacy) Name() string {
+	return BackendSpeedtest
+}
+
+// Servers returns the speedtest.net servers nearest to the client, or the
+// servers at URLs, in order, numbered from 1
+func (b Legacy) Servers(client User) (ServerList, error) {
+	if len(b.URLs) == 0 {
+		return FetchServerList(client), nil
+	}
+	servers := Servers{}
+	for i, rawURL := range b.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ServerList{}, fmt.Errorf("invalid speedtest server %q", rawURL)
+		}
+		// The URL of a server is the one of its upload.php
+		if !strings.HasSuffix(u.Path, "/upload.php") {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/upload.php"
+		}
+		servers = append(servers, Server{
+			URL:  u.String(),
+			Name: u.Host,
+			ID:   strconv.Itoa(i + 1),
+			Host: u.Host,
+		})
+	}
+	return ServerList{Servers: servers}, nil
+}
+
+// Ping returns the latency and jitter to latency.txt
+func (b Legacy) Ping(s Server) (time.Duration, time.Duration, error) {
+	latency, jitter, _, err := b.TracePing(s)
+	return latency, jitter, err
+}
+
+// TracePing returns the latency and jitter to latency.txt, and the timings
+// of the first request
+func (Legacy) TracePing(s Server) (time.Duration, time.Duration, Timings, error) {
+	return pingTest(s.URL)
+}
+
+// Download measures the download speed from the random images
+func (Legacy) Download(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	return downloadTest(legacyRequests(s.URL), latency, count)
+}
+
+// Upload measures the upload speed to upload.php
+func (Legacy) Upload(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	return uploadTest(legacyRequests(s.URL), latency, count)
+}
@@ -0,0 +1,146 @@
+package speedtest
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/speedtest-monitor/app/server/endpoint"
+)
+
+// countingServer : test server counting the connections opened to it
+type countingServer struct {
+	*httptest.Server
+	connections int32
+}
+
+// startServer starts a server of the handler, counting its connections
+func startServer(t *testing.T, handler http.Handler) *countingServer {
+	s := &countingServer{Server: httptest.NewUnstartedServer(handler)}
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&s.connections, 1)
+		}
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// legacyServer returns the server of the URL, as listed by the backend
+func legacyServer(t *testing.T, rawURL string) Server {
+	list, err := Legacy{URLs: []string{rawURL}}.Servers(User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list.Servers[0]
+}
+
+func TestLegacyServers(t *testing.T) {
+	list, err := Legacy{URLs: []string{"http://a.example.com", "https://b.example.com/speedtest/", "http://c.example.com/upload.php"}}.Servers(User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://a.example.com/upload.php", "https://b.example.com/speedtest/upload.php", "http://c.example.com/upload.php"}
+	for i, s := range list.Servers {
+		if s.URL != want[i] || s.ID != strconv.Itoa(i+1) {
+			t.Errorf("got the server %s with URL %s, want %d with %s", s.ID, s.URL, i+1, want[i])
+		}
+	}
+	for _, rawURL := range []string{"ftp://example.com/", "example.com", "http://"} {
+		if _, err := (Legacy{URLs: []string{rawURL}}).Servers(User{}); err == nil {
+			t.Errorf("expected an error for the server %q", rawURL)
+		}
+	}
+}
+
+func TestLegacyEndpoint(t *testing.T) {
+	server := startServer(t, endpoint.NewHandler())
+	s := legacyServer(t, server.URL+"/speedtest/")
+
+	latency, _, timings, err := Legacy{}.TracePing(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 || timings.Connect <= 0 || timings.TTFB < timings.Connect {
+		t.Errorf("unexpected latency %v and timings %+v", latency, timings)
+	}
+	// Every ping request is made on the connection of the traced one
+	if n := atomic.LoadInt32(&server.connections); n != 1 {
+		t.Errorf("the ping opened %d connections, want 1", n)
+	}
+
+	var received int64
+	dl, err := Legacy{}.Download(s, latency, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The warm up downloads 2 images of 750x750, and the test 16 of
+	// 1500x1500 on a fast link
+	if want := int64(2*750*750*2 + 16*1500*1500*2); received != want || dl.WarmUpOnly || dl.Speed <= 0 {
+		t.Errorf("got a download of %f Mbps and %d bytes, want %d bytes (warm up only: %v)", dl.Speed, received, want, dl.WarmUpOnly)
+	}
+
+	var sent int64
+	ul, err := Legacy{}.Upload(s, latency, &sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent <= 0 || ul.WarmUpOnly || ul.Speed <= 0 {
+		t.Errorf("got an upload of %f Mbps and %d bytes (warm up only: %v)", ul.Speed, sent, ul.WarmUpOnly)
+	}
+}
+
+func TestLegacyServerError(t *testing.T) {
+	server := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	s := legacyServer(t, server.URL)
+
+	var count int64
+	if _, err := (Legacy{}).Download(s, 0, &count); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got the download error %v, want a 500", err)
+	}
+	if _, err := (Legacy{}).Upload(s, 0, &count); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got the upload error %v, want a 500", err)
+	}
+
+	server.Close()
+	if _, _, err := (Legacy{}).Ping(s); err == nil {
+		t.Error("expected an error for a closed server")
+	}
+}
+
+func TestTransferParallel(t *testing.T) {
+	var count int64
+	tr := &transfer{count: &count}
+	speed, err := tr.parallel(4, 0, func() error {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&count, 125000)
+		return nil
+	})
+	// 4 Mbit in 10 ms at most
+	if err != nil || speed <= 0 || speed > 400 {
+		t.Errorf("got a speed of %f Mbps, %v", speed, err)
+	}
+
+	// A single request failing fails the test
+	failure := errors.New("failure")
+	var calls int32
+	speed, err = tr.parallel(4, 0, func() error {
+		atomic.AddInt64(&count, 125000)
+		if atomic.AddInt32(&calls, 1) == 3 {
+			return failure
+		}
+		return nil
+	})
+	if err != failure || speed != 0 {
+		t.Errorf("got a speed of %f Mbps and the error %v, want %v", speed, err, failure)
+	}
+}
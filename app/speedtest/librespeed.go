@@ -0,0 +1,284 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackendLibreSpeed : name of the backend speaking the LibreSpeed protocol
+const BackendLibreSpeed = "librespeed"
+
+// LibreSpeedServerList : list of the public LibreSpeed servers
+const LibreSpeedServerList = "https://librespeed.org/backend-servers/servers.php"
+
+// Settings of the LibreSpeed tests, close to those of its reference client
+const (
+	// libreSpeedChunks : MB requested from garbage.php on each download
+	libreSpeedChunks = 100
+	// libreSpeedProbeTimeout : time to wait for each server when sorting
+	// them by latency
+	libreSpeedProbeTimeout = 2 * time.Second
+	// libreSpeedListTimeout : time to wait for the server list
+	libreSpeedListTimeout = 30 * time.Second
+)
+
+var (
+	libreSpeedDownload = streamTest{streams: 6, duration: 10 * time.Second, grace: 1500 * time.Millisecond}
+	libreSpeedUpload   = streamTest{streams: 3, duration: 10 * time.Second, grace: 3 * time.Second}
+)
+
+// LibreSpeed : backend testing against LibreSpeed servers, through their
+// garbage.php, empty.php and getIP.php endpoints
+type LibreSpeed struct {
+	// ServerList : URL or path of the JSON list of servers
+	ServerList string
+}
+
+// libreSpeedServer : entry of a LibreSpeed server list. The URLs of the
+// endpoints are relative to the server URL.
+type libreSpeedServer struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Server      string `json:"server"`
+	DownloadURL string `json:"dlURL"`
+	UploadURL   string `json:"ulURL"`
+	PingURL     string `json:"pingURL"`
+	GetIPURL    string `json:"getIpURL"`
+	SponsorName string `json:"sponsorName"`
+}
+
+// libreSpeedIP : response of getIP.php
+type libreSpeedIP struct {
+	ProcessedString string          `json:"processedString"`
+	RawIspInfo      json.RawMessage `json:"rawIspInfo"`
+}
+
+func init() {
+	RegisterBackend(LibreSpeed{ServerList: LibreSpeedServerList})
+}
+
+// Name returns the name of the backend
+func (LibreSpeed) Name() string {
+	return BackendLibreSpeed
+}
+
+// Servers returns the servers of the list. LibreSpeed servers have no
+// location, so they are sorted by the time to reach them, and the
+// unreachable ones are left last.
+func (b LibreSpeed) Servers(client User) (ServerList, error) {
+	entries, err := b.readList()
+	if err != nil {
+		return ServerList{}, err
+	}
+	servers := Servers{}
+	for _, entry := range entries {
+		s, err := entry.server()
+		if err != nil {
+			log.Warnf("Skipping LibreSpeed server %d (%s): %s", entry.ID, entry.Name, err)
+			continue
+		}
+		servers = append(servers, s)
+	}
+
+	rtts := make([]time.Duration, len(servers))
+	wg := new(sync.WaitGroup)
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rtts[i] = probe(servers[i].endpoints.ping)
+		}(i)
+	}
+	wg.Wait()
+	order := make([]int, len(servers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rtts[order[i]] < rtts[order[j]]
+	})
+	sorted := make(Servers, len(servers))
+	for i, o := range order {
+		sorted[i] = servers[o]
+	}
+	return ServerList{Servers: sorted}, nil
+}
+
+// readList reads the server list from its URL or file
+func (b LibreSpeed) readList() ([]libreSpeedServer, error) {
+	var body []byte
+	var err error
+	if strings.HasPrefix(b.ServerList, "http://") || strings.HasPrefix(b.ServerList, "https://") {
+		body, err = fetch(b.ServerList, libreSpeedListTimeout)
+	} else {
+		body, err = ioutil.ReadFile(b.ServerList)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []libreSpeedServer{}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("invalid server list %s: %s", b.ServerList, err)
+	}
+	return entries, nil
+}
+
+// server returns the Server of the entry, resolving the URLs of its
+// endpoints
+func (e libreSpeedServer) server() (Server, error) {
+	base := e.Server
+	if strings.HasPrefix(base, "//") {
+		base = "https:" + base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return Server{}, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return Server{}, fmt.Errorf("server must be an http(s) URL, got %q", e.Server)
+	}
+	resolve := func(ref, fallback string) (string, error) {
+		if ref == "" {
+			ref = fallback
+		}
+		refURL, err := url.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return baseURL.ResolveReference(refURL).String(), nil
+	}
+
+	s := Server{
+		URL:     baseURL.String(),
+		Name:    e.Name,
+		Sponsor: e.SponsorName,
+		ID:      strconv.Itoa(e.ID),
+		Host:    baseURL.Host,
+	}
+	for _, ep := range []struct {
+		field         *string
+		ref, fallback string
+	}{
+		{&s.endpoints.download, e.DownloadURL, "garbage.php"},
+		{&s.endpoints.upload, e.UploadURL, "empty.php"},
+		{&s.endpoints.ping, e.PingURL, "empty.php"},
+		{&s.endpoints.client, e.GetIPURL, "getIP.php"},
+	} {
+		if *ep.field, err = resolve(ep.ref, ep.fallback); err != nil {
+			return Server{}, err
+		}
+	}
+	return s, nil
+}
+
+// Ping returns the latency and jitter to empty.php
+func (b LibreSpeed) Ping(s Server) (time.Duration, time.Duration, error) {
+	latency, jitter, _, err := b.TracePing(s)
+	return latency, jitter, err
+}
+
+// TracePing returns the latency and jitter to empty.php, and the timings
+// of the first request
+func (LibreSpeed) TracePing(s Server) (time.Duration, time.Duration, Timings, error) {
+	if s.endpoints.ping == "" {
+		return 0, 0, Timings{}, fmt.Errorf("server %s is not a LibreSpeed server", s.ID)
+	}
+	return measureLatency("GET", noCache(s.endpoints.ping))
+}
+
+// Download measures the download speed from garbage.php, on parallel
+// streams
+func (LibreSpeed) Download(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	if s.endpoints.download == "" {
+		return Measurement{}, fmt.Errorf("server %s is not a LibreSpeed server", s.ID)
+	}
+	log.Debug("Running Download Test")
+	tr := &transfer{count: count}
+	return libreSpeedDownload.run(tr, func(ctx context.Context) error {
+		return tr.get(ctx, noCache(s.endpoints.download)+"&ckSize="+strconv.Itoa(libreSpeedChunks))
+	})
+}
+
+// Upload measures the upload speed to empty.php, on parallel streams
+func (LibreSpeed) Upload(s Server, latency time.Duration, count *int64) (Measurement, error) {
+	if s.endpoints.upload == "" {
+		return Measurement{}, fmt.Errorf("server %s is not a LibreSpeed server", s.ID)
+	}
+	log.Debug("Running Upload Test")
+	tr := &transfer{count: count}
+	content := randomPayload()
+	return libreSpeedUpload.run(tr, func(ctx context.Context) error {
+		return tr.post(ctx, noCache(s.endpoints.upload), "application/octet-stream", content)
+	})
+}
+
+// Client returns the IP and ISP of the client reported by getIP.php
+func (LibreSpeed) Client(s Server) (User, error) {
+	if s.endpoints.client == "" {
+		return User{}, fmt.Errorf("server %s is not a LibreSpeed server", s.ID)
+	}
+	body, err := fetch(noCache(s.endpoints.client)+"&isp=true", libreSpeedProbeTimeout)
+	if err != nil {
+		return User{}, err
+	}
+	// Old servers answer with the IP only
+	ip := libreSpeedIP{}
+	if err := json.Unmarshal(body, &ip); err != nil {
+		return User{IP: strings.TrimSpace(string(body))}, nil
+	}
+	// processedString is "<ip> - <isp>, <country> (<distance>)"
+	parts := strings.SplitN(ip.ProcessedString, " - ", 2)
+	user := User{IP: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		isp := parts[1]
+		if i := strings.Index(isp, " ("); i >= 0 {
+			isp = isp[:i]
+		}
+		user.Isp = strings.TrimSpace(isp)
+	}
+	return user, nil
+}
+
+// probe returns the time of a request to the URL, or the longest duration
+// if it fails
+func probe(url string) time.Duration {
+	c := http.Client{Timeout: libreSpeedProbeTimeout}
+	start := time.Now()
+	resp, err := c.Get(noCache(url))
+	if err != nil {
+		return time.Duration(1<<63 - 1)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Since(start)
+}
+
+// fetch returns the body of the URL
+func fetch(url string, timeout time.Duration) ([]byte, error) {
+	c := http.Client{Timeout: timeout}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,193 @@
+package speedtest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLibreSpeed : LibreSpeed server counting the requests to each of its
+// endpoints, the ones under /down/ fail. It also serves the list.
+type fakeLibreSpeed struct {
+	*httptest.Server
+	list     string
+	garbage  int32
+	empty    int32
+	uploaded int64
+}
+
+func startLibreSpeed(t *testing.T) *fakeLibreSpeed {
+	f := &fakeLibreSpeed{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeLibreSpeed) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/down/") {
+		http.Error(w, "down", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/garbage.php"):
+		atomic.AddInt32(&f.garbage, 1)
+		chunks, err := strconv.Atoi(r.URL.Query().Get("ckSize"))
+		if err != nil || chunks != libreSpeedChunks {
+			http.Error(w, "bad ckSize", http.StatusBadRequest)
+			return
+		}
+		// A chunk per request is enough for the test
+		w.Write(make([]byte, 1<<20))
+	case strings.HasSuffix(r.URL.Path, "/empty.php"), strings.HasSuffix(r.URL.Path, "/ping.php"):
+		atomic.AddInt32(&f.empty, 1)
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt64(&f.uploaded, n)
+	case r.URL.Path == "/servers.json":
+		fmt.Fprint(w, f.list)
+	case strings.HasSuffix(r.URL.Path, "/getIP.php"):
+		fmt.Fprint(w, `{"processedString":"203.0.113.5 - Example ISP, FR (12 km)","rawIspInfo":""}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// shortTests runs the stream tests for a short time, until the test ends
+func shortTests(t *testing.T) {
+	download, upload := libreSpeedDownload, libreSpeedUpload
+	libreSpeedDownload = streamTest{streams: 2, duration: 300 * time.Millisecond, grace: 100 * time.Millisecond}
+	libreSpeedUpload = streamTest{streams: 2, duration: 300 * time.Millisecond, grace: 100 * time.Millisecond}
+	t.Cleanup(func() {
+		libreSpeedDownload, libreSpeedUpload = download, upload
+	})
+}
+
+// libreSpeedServerOf returns the server of the entry, failing the test if
+// it's invalid
+func libreSpeedServerOf(t *testing.T, entry libreSpeedServer) Server {
+	s, err := entry.server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLibreSpeedServers(t *testing.T) {
+	f := startLibreSpeed(t)
+	f.list = fmt.Sprintf(`[
+		{"id": 1, "name": "Down", "server": "%[1]s/down/", "sponsorName": "Sponsor 1"},
+		{"id": 2, "name": "Up", "server": "%[1]s/up", "dlURL": "files/garbage.php", "pingURL": "ping.php"},
+		{"id": 3, "name": "FTP", "server": "ftp://example.com/"}
+	]`, f.URL)
+	path := t.TempDir() + "/servers.json"
+	if err := ioutil.WriteFile(path, []byte(f.list), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := LibreSpeed{ServerList: path}.Servers(User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The FTP server is skipped, and the unreachable one left last
+	if len(servers.Servers) != 2 {
+		t.Fatalf("got %d servers, want 2", len(servers.Servers))
+	}
+	up, down := servers.Servers[0], servers.Servers[1]
+	if up.ID != "2" || down.ID != "1" || down.Sponsor != "Sponsor 1" {
+		t.Errorf("unexpected servers %+v and %+v", up, down)
+	}
+	want := endpoints{
+		download: f.URL + "/up/files/garbage.php",
+		upload:   f.URL + "/up/empty.php",
+		ping:     f.URL + "/up/ping.php",
+		client:   f.URL + "/up/getIP.php",
+	}
+	if up.URL != f.URL+"/up/" || up.endpoints != want {
+		t.Errorf("got the URL %s and endpoints %+v, want %+v", up.URL, up.endpoints, want)
+	}
+
+	fetched, err := LibreSpeed{ServerList: f.URL + "/servers.json"}.Servers(User{})
+	if err != nil || len(fetched.Servers) != 2 || fetched.Servers[0].endpoints != want {
+		t.Errorf("got the fetched servers %+v, %v", fetched.Servers, err)
+	}
+	if _, err := (LibreSpeed{ServerList: f.URL + "/down/servers.json"}).Servers(User{}); err == nil {
+		t.Error("expected an error for a failing server list")
+	}
+}
+
+func TestLibreSpeedPing(t *testing.T) {
+	f := startLibreSpeed(t)
+	s := libreSpeedServerOf(t, libreSpeedServer{ID: 1, Server: f.URL})
+
+	latency, _, timings, err := LibreSpeed{}.TracePing(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 || timings.TTFB <= 0 {
+		t.Errorf("unexpected latency %v and timings %+v", latency, timings)
+	}
+	// The round trips are measured after the traced request
+	if n := atomic.LoadInt32(&f.empty); n != pingCount+1 {
+		t.Errorf("got %d ping requests, want %d", n, pingCount+1)
+	}
+	if _, _, err := (LibreSpeed{}).Ping(Server{ID: "1"}); err == nil {
+		t.Error("expected an error for a server without endpoints")
+	}
+}
+
+func TestLibreSpeedDownloadUpload(t *testing.T) {
+	shortTests(t)
+	f := startLibreSpeed(t)
+	s := libreSpeedServerOf(t, libreSpeedServer{ID: 1, Server: f.URL})
+
+	var received int64
+	dl, err := LibreSpeed{}.Download(s, 0, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Speed <= 0 || received <= 0 || atomic.LoadInt32(&f.garbage) == 0 {
+		t.Errorf("got a download of %f Mbps, %d bytes", dl.Speed, received)
+	}
+
+	var sent int64
+	ul, err := LibreSpeed{}.Upload(s, 0, &sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul.Speed <= 0 || sent <= 0 || atomic.LoadInt64(&f.uploaded) == 0 {
+		t.Errorf("got an upload of %f Mbps, %d bytes", ul.Speed, sent)
+	}
+
+	user, err := LibreSpeed{}.Client(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IP != "203.0.113.5" || user.Isp != "Example ISP, FR" {
+		t.Errorf("unexpected client %+v", user)
+	}
+}
+
+func TestLibreSpeedServerError(t *testing.T) {
+	shortTests(t)
+	f := startLibreSpeed(t)
+	s := libreSpeedServerOf(t, libreSpeedServer{ID: 1, Server: f.URL + "/down/"})
+
+	var count int64
+	if _, err := (LibreSpeed{}).Download(s, 0, &count); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got the download error %v, want a 500", err)
+	}
+	if _, err := (LibreSpeed{}).Upload(s, 0, &count); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got the upload error %v, want a 500", err)
+	}
+
+	f.Close()
+	if _, _, err := (LibreSpeed{}).Ping(s); err == nil {
+		t.Error("expected an error for a closed server")
+	}
+}
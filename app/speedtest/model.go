@@ -17,10 +17,30 @@ type Server struct {
 	ID       string `xml:"id,attr"`
 	URL2     string `xml:"url2,attr"`
 	Host     string `xml:"host,attr"`
+	Backend  string `xml:"-"`
 	Distance float64
 	DLSpeed  float64
 	ULSpeed  float64
 	Ping     time.Duration
+	Jitter   time.Duration
+	Error    string
+
+	BytesReceived int64
+	BytesSent     int64
+	Duration      time.Duration
+	WarmUpOnly    bool
+	Timings       Timings
+
+	endpoints endpoints
+}
+
+// endpoints : URLs of the tests of a server, for the backends whose
+// servers don't follow the speedtest.net layout
+type endpoints struct {
+	download string
+	upload   string
+	ping     string
+	client   string
 }
 
 // ServerList : List of Server
@@ -36,7 +56,8 @@ type ByDistance struct {
 	Servers
 }
 
-// LatestResult : keeps strings with the latest measurements
+// LatestResult : keeps strings with the latest measurements. This is the
+// format served by /getLatestResult, see Result for the versioned one.
 type LatestResult struct {
 	DownSpeed    float64
 	DownSpeedStr string
@@ -44,6 +65,22 @@ type LatestResult struct {
 	UpSpeed      float64
 	UpSpeedStr   string
 	LastQuery    string
+	Aggregate    string
+	Servers      []ServerResult
+}
+
+// ServerResult : measurements of a single server. Ping and Jitter are in
+// milliseconds, Download and Upload in Mbit/s
+type ServerResult struct {
+	ID       string
+	Sponsor  string
+	Name     string
+	Distance float64
+	Ping     float64
+	Jitter   float64
+	Download float64
+	Upload   float64
+	Error    string
 }
 
 func checkError(err error) {
@@ -0,0 +1,111 @@
+package speedtest
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of the test of a server, reported in Progress
+const (
+	PhasePing     = "ping"
+	PhaseDownload = "download"
+	PhaseUpload   = "upload"
+	PhaseDone     = "done"
+)
+
+// progressInterval : time between the progress reports of a transfer
+const progressInterval = 100 * time.Millisecond
+
+// Progress : state of the running test, reported to the progress hook
+type Progress struct {
+	Server   Server
+	Position int
+	Total    int
+	Phase    string
+	Bytes    int64
+	Elapsed  time.Duration
+}
+
+// Mbps returns the throughput of the current phase in Mbit/s
+func (p Progress) Mbps() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) * 8 / 1e6 / p.Elapsed.Seconds()
+}
+
+// ProgressFunc receives the progress of the running tests. It's called
+// from the goroutines running the tests, so it must not block.
+type ProgressFunc func(Progress)
+
+var (
+	progressMu   sync.RWMutex
+	progressHook ProgressFunc
+)
+
+// SetProgressHook sets the function receiving the progress of the running
+// tests, or removes it if nil
+func SetProgressHook(fn ProgressFunc) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	progressHook = fn
+}
+
+func reportProgress(p Progress) {
+	progressMu.RLock()
+	fn := progressHook
+	progressMu.RUnlock()
+	if fn != nil {
+		fn(p)
+	}
+}
+
+// tracker reports the progress of the test of a server
+type tracker struct {
+	server   Server
+	position int
+	total    int
+}
+
+// phase reports the start of a phase without transfers
+func (t tracker) phase(phase string) {
+	reportProgress(Progress{Server: t.server, Position: t.position, Total: t.total, Phase: phase})
+}
+
+// watch reports the bytes counted by a transfer periodically, until the
+// returned function is called
+func (t tracker) watch(phase string, bytes *int64) (stop func()) {
+	start := time.Now()
+	report := func() {
+		reportProgress(Progress{
+			Server:   t.server,
+			Position: t.position,
+			Total:    t.total,
+			Phase:    phase,
+			Bytes:    atomic.LoadInt64(bytes),
+			Elapsed:  time.Since(start),
+		})
+	}
+
+	stopped, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		report()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stopped:
+				report()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
@@ -1,12 +1,15 @@
 package speedtest
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,21 +19,113 @@ var dlSizes = [...]int{350, 500, 750, 1000, 1500, 2000, 2500, 3000, 3500, 4000}
 var ulSizes = [...]int{100, 300, 500, 800, 1000, 1500, 2500, 3000, 3500, 4000} //kB
 var client = http.Client{}
 
-func downloadTest(sURL string, latency time.Duration) float64 {
-	dlURL := strings.Split(sURL, "/upload")[0]
-	log.Debug("Running Download Test")
-	wg := new(sync.WaitGroup)
+// pingCount : number of requests used to measure latency and jitter
+const pingCount = 5
 
-	// Warming up
+// transfer keeps the bytes moved and the first error reported by the
+// concurrent requests of a test
+type transfer struct {
+	mu    sync.Mutex
+	err   error
+	count *int64
+}
+
+func (t *transfer) fail(err error) {
+	if err == nil {
+		return
+	}
+	checkError(err)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// counter counts the bytes read through it as they are transferred, so
+// the progress can be reported while the requests run
+type counter struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (c counter) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// receive reads the body of a response, counting the bytes received
+func (t *transfer) receive(body io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, counter{body, t.count})
+	return err
+}
+
+// parallel runs n requests at once, and returns the speed of the bytes
+// they moved in Mbit/s. The latency is taken out of the time, as the first
+// byte only arrives after it.
+func (t *transfer) parallel(n int, latency time.Duration, request func() error) (float64, error) {
+	before := atomic.LoadInt64(t.count)
+	wg := new(sync.WaitGroup)
 	sTime := time.Now()
-	for i := 0; i < 2; i++ {
+	for i := 0; i < n; i++ {
 		wg.Add(1)
-		go dlWarmUp(wg, dlURL)
+		go func() {
+			defer wg.Done()
+			t.fail(request())
+		}()
 	}
 	wg.Wait()
-	fTime := time.Now()
-	// 1.125MB for each request (750 * 750 * 2)
-	wuSpeed := 1.125 * 8 * 2 / fTime.Sub(sTime.Add(latency)).Seconds()
+	elapsed := time.Since(sTime) - latency
+	if t.err != nil {
+		return 0, t.err
+	}
+	if elapsed <= 0 {
+		elapsed = time.Since(sTime)
+	}
+	return float64(atomic.LoadInt64(t.count)-before) * 8 / 1e6 / elapsed.Seconds(), nil
+}
+
+// httpRequests : requests of the download and upload tests against an
+// HTTP server. The weight picks the size of each request from dlSizes and
+// ulSizes.
+type httpRequests struct {
+	downloadURL   func(weight int) string
+	uploadURL     string
+	uploadContent func(weight int) []byte
+	contentType   string
+}
+
+// legacyRequests returns the requests of a speedtest.net server, whose
+// URL is the one of its upload.php
+func legacyRequests(sURL string) httpRequests {
+	dlURL := strings.Split(sURL, "/upload")[0]
+	return httpRequests{
+		downloadURL: func(w int) string {
+			size := strconv.Itoa(dlSizes[w])
+			return dlURL + "/random" + size + "x" + size + ".jpg"
+		},
+		uploadURL: sURL,
+		uploadContent: func(w int) []byte {
+			v := url.Values{}
+			v.Add("content", strings.Repeat("0123456789", ulSizes[w]*100-51))
+			return []byte(v.Encode())
+		},
+		contentType: "application/x-www-form-urlencoded",
+	}
+}
+
+func downloadTest(r httpRequests, latency time.Duration, count *int64) (Measurement, error) {
+	log.Debug("Running Download Test")
+	tr := &transfer{count: count}
+
+	// Warming up
+	wuSpeed, err := tr.parallel(2, latency, func() error {
+		return tr.get(context.Background(), r.downloadURL(2))
+	})
+	if err != nil {
+		return Measurement{}, err
+	}
 
 	// Decide workload by warm up speed
 	workload := 0
@@ -52,36 +147,26 @@ func downloadTest(sURL string, latency time.Duration) float64 {
 	// Main speedtest
 	dlSpeed := wuSpeed
 	if skip == false {
-		sTime = time.Now()
-		for i := 0; i < workload; i++ {
-			wg.Add(1)
-			go downloadRequest(wg, dlURL, weight)
-		}
-		wg.Wait()
-		fTime = time.Now()
-
-		reqMB := dlSizes[weight] * dlSizes[weight] * 2 / 1000 / 1000
-		dlSpeed = float64(reqMB) * 8 * float64(workload) / fTime.Sub(sTime).Seconds()
+		dlSpeed, err = tr.parallel(workload, 0, func() error {
+			return tr.get(context.Background(), r.downloadURL(weight))
+		})
 	}
 
-	return dlSpeed
+	return Measurement{Speed: dlSpeed, WarmUpOnly: skip}, err
 }
 
-func uploadTest(sURL string, latency time.Duration) float64 {
+func uploadTest(r httpRequests, latency time.Duration, count *int64) (Measurement, error) {
 	log.Debug("Running Upload Test")
-	wg := new(sync.WaitGroup)
+	tr := &transfer{count: count}
 
 	// Warm up
-	sTime := time.Now()
-	wg = new(sync.WaitGroup)
-	for i := 0; i < 2; i++ {
-		wg.Add(1)
-		go ulWarmUp(wg, sURL)
+	wuContent := r.uploadContent(4)
+	wuSpeed, err := tr.parallel(2, latency, func() error {
+		return tr.post(context.Background(), r.uploadURL, r.contentType, wuContent)
+	})
+	if err != nil {
+		return Measurement{}, err
 	}
-	wg.Wait()
-	fTime := time.Now()
-	// 1.0 MB for each request
-	wuSpeed := 1.0 * 8 * 2 / fTime.Sub(sTime.Add(latency)).Seconds()
 
 	// Decide workload by warm up speed
 	workload := 0
@@ -103,86 +188,88 @@ func uploadTest(sURL string, latency time.Duration) float64 {
 	// Main speedtest
 	ulSpeed := wuSpeed
 	if skip == false {
-		sTime = time.Now()
-		for i := 0; i < workload; i++ {
-			wg.Add(1)
-			go uploadRequest(wg, sURL, weight)
-		}
-		wg.Wait()
-		fTime = time.Now()
-		reqMB := float64(ulSizes[weight]) / 1000
-		ulSpeed = reqMB * 8 * float64(workload) / fTime.Sub(sTime).Seconds()
+		content := r.uploadContent(weight)
+		ulSpeed, err = tr.parallel(workload, 0, func() error {
+			return tr.post(context.Background(), r.uploadURL, r.contentType, content)
+		})
 	}
 
-	return ulSpeed
-}
-
-func dlWarmUp(wg *sync.WaitGroup, dlURL string) {
-	size := dlSizes[2]
-	url := dlURL + "/random" + strconv.Itoa(size) + "x" + strconv.Itoa(size) + ".jpg"
-
-	resp, err := client.Get(url)
-	checkError(err)
-	defer resp.Body.Close()
-	ioutil.ReadAll(resp.Body)
-
-	wg.Done()
-}
-
-func ulWarmUp(wg *sync.WaitGroup, ulURL string) {
-	size := ulSizes[4]
-	v := url.Values{}
-	v.Add("content", strings.Repeat("0123456789", size*100-51))
-
-	resp, err := client.PostForm(ulURL, v)
-	checkError(err)
-	defer resp.Body.Close()
-	ioutil.ReadAll(resp.Body)
-
-	wg.Done()
+	return Measurement{Speed: ulSpeed, WarmUpOnly: skip}, err
 }
 
-func downloadRequest(wg *sync.WaitGroup, dlURL string, w int) {
-	size := dlSizes[w]
-	url := dlURL + "/random" + strconv.Itoa(size) + "x" + strconv.Itoa(size) + ".jpg"
-
-	resp, err := client.Get(url)
-	checkError(err)
-	defer resp.Body.Close()
-	ioutil.ReadAll(resp.Body)
-	wg.Done()
+// pingTest measures the latency and jitter to the latency.txt endpoint of
+// the server
+func pingTest(sURL string) (time.Duration, time.Duration, Timings, error) {
+	return measureLatency("GET", strings.Split(sURL, "/upload")[0]+"/latency.txt")
 }
 
-func uploadRequest(wg *sync.WaitGroup, ulURL string, w int) {
-	size := ulSizes[9]
-	v := url.Values{}
-	v.Add("content", strings.Repeat("0123456789", size*100-51))
+// measureLatency measures the latency (half of the fastest round trip) and
+// the jitter (mean difference between consecutive round trips) to the URL,
+// requested with the method. A first request is made on a new connection,
+// and its timings returned, while the round trips are those of the next
+// ones, reusing the connection.
+func measureLatency(method string, pingURL string) (time.Duration, time.Duration, Timings, error) {
+	// A client of its own, so the first request can't reuse a connection
+	// of the tests, nor close them
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defer transport.CloseIdleConnections()
+	c := http.Client{Transport: transport}
 
-	resp, err := client.PostForm(ulURL, v)
-	checkError(err)
-	defer resp.Body.Close()
-	ioutil.ReadAll(resp.Body)
+	var lastErr error
+	samples := []time.Duration{}
+	trace := &requestTrace{}
+	for i := 0; i <= pingCount; i++ {
+		sTime := time.Now()
+		request, err := http.NewRequest(method, pingURL, nil)
+		var resp *http.Response
+		if err == nil {
+			if i == 0 {
+				request = trace.attach(request)
+			}
+			resp, err = c.Do(request)
+		}
+		fTime := time.Now()
+		if err != nil {
+			checkError(err)
+			lastErr = err
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if i > 0 {
+			samples = append(samples, fTime.Sub(sTime))
+		}
+	}
+	if len(samples) == 0 {
+		return 0, 0, Timings{}, lastErr
+	}
 
-	//log.Debug(".")
-	wg.Done()
+	l, jitter := latencyOf(samples)
+	log.Infof("Latency: %v, Jitter: %v", l, jitter)
+	return l, jitter, trace.result(), nil
 }
 
-func pingTest(sURL string) time.Duration {
-	pingURL := strings.Split(sURL, "/upload")[0] + "/latency.txt"
-
-	l := time.Duration(100000000000) // 10sec
-	for i := 0; i < 3; i++ {
-		sTime := time.Now()
-		resp, err := http.Get(pingURL)
-		fTime := time.Now()
-		checkError(err)
-		defer resp.Body.Close()
-		if fTime.Sub(sTime) < l {
-			l = fTime.Sub(sTime)
+// latencyOf returns the latency (half of the fastest round trip) and the
+// jitter (mean difference between consecutive round trips) of the samples
+func latencyOf(samples []time.Duration) (time.Duration, time.Duration) {
+	l := samples[0]
+	jitter := time.Duration(0)
+	for i, sample := range samples {
+		if sample < l {
+			l = sample
+		}
+		if i > 0 {
+			diff := sample - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
 		}
 	}
 	l /= 2.0
+	if len(samples) > 1 {
+		jitter /= time.Duration(len(samples) - 1)
+	}
 
-	log.Infof("Latency: %v", l)
-	return l
+	return l, jitter
 }
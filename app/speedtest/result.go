@@ -0,0 +1,137 @@
+package speedtest
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResultSchemaVersion : version of the Result schema, increased on every
+// incompatible change
+const ResultSchemaVersion = 1
+
+// Result : measurements of a speedtest run, served by the versioned API.
+// Speeds are in bits per second and times in milliseconds. The DNS,
+// connect, TLS and TTFB times are those of a request on a new connection,
+// 0 if the backend doesn't measure them.
+type Result struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	Timestamp     time.Time           `json:"timestamp"`
+	DurationMs    float64             `json:"durationMs"`
+	Aggregate     string              `json:"aggregate"`
+	DownloadBps   float64             `json:"downloadBps"`
+	UploadBps     float64             `json:"uploadBps"`
+	PingMs        float64             `json:"pingMs"`
+	JitterMs      float64             `json:"jitterMs"`
+	DNSMs         float64             `json:"dnsMs"`
+	ConnectMs     float64             `json:"connectMs"`
+	TLSMs         float64             `json:"tlsMs"`
+	TTFBMs        float64             `json:"ttfbMs"`
+	BytesReceived int64               `json:"bytesReceived"`
+	BytesSent     int64               `json:"bytesSent"`
+	Client        ClientInfo          `json:"client"`
+	Servers       []ServerMeasurement `json:"servers"`
+	Quality       string              `json:"quality"`
+	Issues        []string            `json:"issues,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// ClientInfo : information of the host running the tests
+type ClientInfo struct {
+	IP  string  `json:"ip"`
+	ISP string  `json:"isp"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// ServerMeasurement : measurements of a single server
+type ServerMeasurement struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Country       string  `json:"country"`
+	Sponsor       string  `json:"sponsor"`
+	Host          string  `json:"host"`
+	Backend       string  `json:"backend,omitempty"`
+	DistanceKm    float64 `json:"distanceKm"`
+	PingMs        float64 `json:"pingMs"`
+	JitterMs      float64 `json:"jitterMs"`
+	DNSMs         float64 `json:"dnsMs"`
+	ConnectMs     float64 `json:"connectMs"`
+	TLSMs         float64 `json:"tlsMs"`
+	TTFBMs        float64 `json:"ttfbMs"`
+	DownloadBps   float64 `json:"downloadBps"`
+	UploadBps     float64 `json:"uploadBps"`
+	BytesReceived int64   `json:"bytesReceived"`
+	BytesSent     int64   `json:"bytesSent"`
+	DurationMs    float64 `json:"durationMs"`
+	WarmUpOnly    bool    `json:"warmUpOnly"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// DownloadMbps returns the download speed in Mbit/s
+func (r Result) DownloadMbps() float64 {
+	return r.DownloadBps / 1e6
+}
+
+// UploadMbps returns the upload speed in Mbit/s
+func (r Result) UploadMbps() float64 {
+	return r.UploadBps / 1e6
+}
+
+// Show logs the measurements of the result
+func (r Result) Show() {
+	for _, s := range r.Servers {
+		if s.Error != "" {
+			log.Warnf("[%4s] Test failed: %s", s.ID, s.Error)
+		} else if len(r.Servers) > 1 {
+			log.Infof("[%4s] Download: %5.2f Mbit/s, Upload: %5.2f Mbit/s\n", s.ID, s.DownloadBps/1e6, s.UploadBps/1e6)
+		}
+	}
+	legacy := r.Legacy()
+	log.Info(legacy.DownSpeedStr)
+	log.Info(legacy.UpSpeedStr)
+}
+
+// Legacy converts the result to the format served by /getLatestResult
+func (r Result) Legacy() LatestResult {
+	if r.Timestamp.IsZero() {
+		return LatestResult{}
+	}
+
+	lr := LatestResult{
+		DownSpeed: r.DownloadMbps(),
+		UpSpeed:   r.UploadMbps(),
+		LastQuery: r.Timestamp.Add(msToDuration(r.DurationMs)).String(),
+		Aggregate: r.Aggregate,
+		Servers:   make([]ServerResult, 0, len(r.Servers)),
+	}
+	if len(r.Servers) == 1 {
+		lr.DownSpeedStr = fmt.Sprintf("Download: %5.2f Mbit/s", lr.DownSpeed)
+		lr.UpSpeedStr = fmt.Sprintf("Upload: %5.2f Mbit/s", lr.UpSpeed)
+		lr.Ping = fmt.Sprint("Latency: ", msToDuration(r.PingMs))
+	} else {
+		label := aggregateLabels[r.Aggregate]
+		lr.DownSpeedStr = fmt.Sprintf("Download %s: %5.2f Mbit/s", label, lr.DownSpeed)
+		lr.UpSpeedStr = fmt.Sprintf("Upload %s: %5.2f Mbit/s", label, lr.UpSpeed)
+		lr.Ping = fmt.Sprintf("Latency %s: %5.2f ms", label, r.PingMs)
+	}
+	for _, s := range r.Servers {
+		lr.Servers = append(lr.Servers, ServerResult{
+			ID:       s.ID,
+			Sponsor:  s.Sponsor,
+			Name:     s.Name,
+			Distance: s.DistanceKm,
+			Ping:     s.PingMs,
+			Jitter:   s.JitterMs,
+			Download: s.DownloadBps / 1e6,
+			Upload:   s.UploadBps / 1e6,
+			Error:    s.Error,
+		})
+	}
+	return lr
+}
+
+func msToDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -109,6 +110,23 @@ func (l *ServerList) FindServer(serverID []int) Servers {
 	return servers
 }
 
+// Filter returns the servers whose name, country or sponsor contain the
+// query, ignoring case, up to limit servers if limit is positive
+func (l ServerList) Filter(query string, limit int) ServerList {
+	query = strings.ToLower(query)
+	filtered := ServerList{Servers: Servers{}}
+	for _, s := range l.Servers {
+		if limit > 0 && len(filtered.Servers) >= limit {
+			break
+		}
+		text := strings.ToLower(s.Name + " " + s.Country + " " + s.Sponsor)
+		if strings.Contains(text, query) {
+			filtered.Servers = append(filtered.Servers, s)
+		}
+	}
+	return filtered
+}
+
 // Show : show server list
 func (l ServerList) Show() {
 	for _, s := range l.Servers {
@@ -123,68 +141,156 @@ func (s Server) Show() {
 	log.Info(s.Name + " (" + s.Country + ") by " + s.Sponsor + "\n")
 }
 
-// TestNow starts the test and shows the results
-func (svrs *Servers) TestNow(latestResults *LatestResult) {
+// TestNow starts the test and shows the results. The measurements of
+// multiple servers are combined with the aggregate function.
+func (svrs Servers) TestNow(client User, aggregate string) Result {
+	start := time.Now()
 	svrs.StartTest()
-	svrs.ShowResult(latestResults)
+	result := svrs.NewResult(client, aggregate, start, time.Since(start))
+	result.Show()
+	return result
 }
 
 // StartTest : start testing to the servers.
 func (svrs Servers) StartTest() {
 	for i, s := range svrs {
 		s.Show()
-		latency := pingTest(s.URL)
-		dlSpeed := downloadTest(s.URL, latency)
-		ulSpeed := uploadTest(s.URL, latency)
-		svrs[i].DLSpeed = dlSpeed
-		svrs[i].ULSpeed = ulSpeed
-		svrs[i].Ping = latency
+		sTime := time.Now()
+		svrs[i].test(tracker{server: s, position: i + 1, total: len(svrs)})
+		svrs[i].Duration = time.Since(sTime)
 	}
 }
 
-// ShowResult : show testing result
-func (svrs Servers) ShowResult(latestResult *LatestResult) {
-	fmt.Printf(" \n")
-	if len(svrs) == 1 {
-		latestResult.DownSpeed = svrs[0].DLSpeed
-		latestResult.DownSpeedStr = fmt.Sprintf("Download: %5.2f Mbit/s", svrs[0].DLSpeed)
-		latestResult.UpSpeed = svrs[0].ULSpeed
-		latestResult.UpSpeedStr = fmt.Sprintf("Upload: %5.2f Mbit/s", svrs[0].ULSpeed)
-		latestResult.Ping = fmt.Sprint("Latency: ", svrs[0].Ping)
+// test measures the latency, download and upload speed of the server
+// with its backend, stopping at the first failure, and reports its
+// progress to tk
+func (s *Server) test(tk tracker) {
+	s.DLSpeed, s.ULSpeed, s.Ping, s.Jitter, s.Error = 0, 0, 0, 0, ""
+	s.BytesReceived, s.BytesSent, s.WarmUpOnly, s.Timings = 0, 0, false, Timings{}
+	defer tk.phase(PhaseDone)
+
+	backend, err := GetBackend(s.Backend)
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+
+	tk.phase(PhasePing)
+	tracer, tracing := backend.(Tracer)
+	var latency, jitter time.Duration
+	var timings Timings
+	if tracing {
+		latency, jitter, timings, err = tracer.TracePing(*s)
 	} else {
-		avgDL := 0.0
-		avgUL := 0.0
-		avgPing := 0.0
-		for _, s := range svrs {
-			log.Infof("[%4s] Download: %5.2f Mbit/s, Upload: %5.2f Mbit/s\n", s.ID, s.DLSpeed, s.ULSpeed)
-			avgDL = avgDL + s.DLSpeed
-			avgUL = avgUL + s.ULSpeed
-			avgPing = avgPing + float64(s.Ping)
-		}
-		latestResult.DownSpeed = avgDL / float64(len(svrs))
-		latestResult.DownSpeedStr = fmt.Sprintf("Download Avg: %5.2f Mbit/s", avgDL/float64(len(svrs)))
-		latestResult.UpSpeed = avgUL / float64(len(svrs))
-		latestResult.UpSpeedStr = fmt.Sprintf("Upload Avg: %5.2f Mbit/s", avgUL/float64(len(svrs)))
-		latestResult.Ping = fmt.Sprintf("Upload Avg: %5.2f ms", avgPing/float64(len(svrs)))
-	}
-	latestResult.LastQuery = time.Now().String()
-	log.Info(latestResult.DownSpeedStr)
-	log.Info(latestResult.UpSpeedStr)
-	err := svrs.checkResult()
-	if err {
-		log.Warn("Warning: Result seems to be wrong. Please speedtest again.")
+		latency, jitter, err = backend.Ping(*s)
+	}
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.Ping = latency
+	s.Jitter = jitter
+	if tracing {
+		log.Infof("DNS: %v, Connect: %v, TLS: %v, TTFB: %v", timings.DNS, timings.Connect, timings.TLS, timings.TTFB)
+		s.Timings = timings
+	}
+
+	stop := tk.watch(PhaseDownload, &s.BytesReceived)
+	dl, err := backend.Download(*s, latency, &s.BytesReceived)
+	stop()
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.DLSpeed = dl.Speed
+
+	stop = tk.watch(PhaseUpload, &s.BytesSent)
+	ul, err := backend.Upload(*s, latency, &s.BytesSent)
+	stop()
+	if err != nil {
+		s.Error = err.Error()
+		return
 	}
+	s.ULSpeed = ul.Speed
+	s.WarmUpOnly = dl.WarmUpOnly || ul.WarmUpOnly
 }
 
-func (svrs Servers) checkResult() bool {
-	errFlg := false
-	if len(svrs) == 1 {
-		s := svrs[0]
-		errFlg = (s.DLSpeed*100 < s.ULSpeed) || (s.DLSpeed > s.ULSpeed*100)
-	} else {
-		for _, s := range svrs {
-			errFlg = errFlg || (s.DLSpeed*100 < s.ULSpeed) || (s.DLSpeed > s.ULSpeed*100)
+// Measurement : measurements of the server, as reported in the results
+func (s Server) Measurement() ServerMeasurement {
+	return ServerMeasurement{
+		ID:            s.ID,
+		Name:          s.Name,
+		Country:       s.Country,
+		Sponsor:       s.Sponsor,
+		Host:          s.Host,
+		Backend:       s.Backend,
+		DistanceKm:    s.Distance,
+		PingMs:        durationToMs(s.Ping),
+		JitterMs:      durationToMs(s.Jitter),
+		DNSMs:         durationToMs(s.Timings.DNS),
+		ConnectMs:     durationToMs(s.Timings.Connect),
+		TLSMs:         durationToMs(s.Timings.TLS),
+		TTFBMs:        durationToMs(s.Timings.TTFB),
+		DownloadBps:   s.DLSpeed * 1e6,
+		UploadBps:     s.ULSpeed * 1e6,
+		BytesReceived: s.BytesReceived,
+		BytesSent:     s.BytesSent,
+		DurationMs:    durationToMs(s.Duration),
+		WarmUpOnly:    s.WarmUpOnly,
+		Error:         s.Error,
+	}
+}
+
+// NewResult combines the measurements of the tested servers into a Result
+func (svrs Servers) NewResult(client User, aggregateFn string, start time.Time, duration time.Duration) Result {
+	if aggregateFn == "" {
+		aggregateFn = AggregateMean
+	}
+	result := Result{
+		SchemaVersion: ResultSchemaVersion,
+		Timestamp:     start.Round(time.Millisecond),
+		DurationMs:    durationToMs(duration),
+		Aggregate:     aggregateFn,
+		Client:        client.Info(),
+		Servers:       make([]ServerMeasurement, 0, len(svrs)),
+	}
+
+	dl, ul, ping, jitter := []float64{}, []float64{}, []float64{}, []float64{}
+	dns, connect, tlsTime, ttfb := []float64{}, []float64{}, []float64{}, []float64{}
+	errs := []string{}
+	for _, s := range svrs {
+		m := s.Measurement()
+		result.Servers = append(result.Servers, m)
+		result.BytesReceived += m.BytesReceived
+		result.BytesSent += m.BytesSent
+		if m.Error != "" {
+			errs = append(errs, fmt.Sprintf("[%s] %s", m.ID, m.Error))
+			continue
 		}
+		dl = append(dl, m.DownloadBps)
+		ul = append(ul, m.UploadBps)
+		ping = append(ping, m.PingMs)
+		jitter = append(jitter, m.JitterMs)
+		dns = append(dns, m.DNSMs)
+		connect = append(connect, m.ConnectMs)
+		tlsTime = append(tlsTime, m.TLSMs)
+		ttfb = append(ttfb, m.TTFBMs)
+	}
+	if len(dl) == 0 && len(errs) > 0 {
+		result.Error = strings.Join(errs, "; ")
 	}
-	return errFlg
+
+	result.DownloadBps = aggregate(aggregateFn, dl)
+	result.UploadBps = aggregate(aggregateFn, ul)
+	result.PingMs = aggregate(aggregateFn, ping)
+	result.JitterMs = aggregate(aggregateFn, jitter)
+	result.DNSMs = aggregate(aggregateFn, dns)
+	result.ConnectMs = aggregate(aggregateFn, connect)
+	result.TLSMs = aggregate(aggregateFn, tlsTime)
+	result.TTFBMs = aggregate(aggregateFn, ttfb)
+	return result
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
 }
@@ -0,0 +1,109 @@
+package speedtest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sampling strategies, deciding which target servers are tested on each poll
+const (
+	// StrategyAll tests every target server on each poll
+	StrategyAll = "all"
+	// StrategyRoundRobin tests a single server on each poll, rotating through the targets
+	StrategyRoundRobin = "round-robin"
+	// StrategyRandom tests a random subset of the targets on each poll
+	StrategyRandom = "random"
+	// StrategyPrimary tests the first target on each poll, and one of the
+	// others every few polls
+	StrategyPrimary = "primary"
+)
+
+// Strategies lists the valid sampling strategies
+var Strategies = []string{StrategyAll, StrategyRoundRobin, StrategyRandom, StrategyPrimary}
+
+// Sampler picks the servers to be tested on each poll, according to
+// its strategy
+type Sampler struct {
+	strategy       string
+	sampleSize     int
+	secondaryEvery int
+	targets        *Servers
+	polls          int
+	secondary      int
+	rnd            *rand.Rand
+	mu             sync.Mutex
+}
+
+// NewSampler creates a Sampler for the target servers. sampleSize is the
+// number of servers tested per poll by the random strategy, and
+// secondaryEvery the number of polls between each secondary test of the
+// primary strategy.
+func NewSampler(strategy string, targets *Servers, sampleSize int, secondaryEvery int) (*Sampler, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyAll
+	case StrategyAll, StrategyRoundRobin, StrategyRandom, StrategyPrimary:
+	default:
+		return nil, fmt.Errorf("unknown sampling strategy %q", strategy)
+	}
+	if sampleSize < 1 {
+		sampleSize = 1
+	}
+	if secondaryEvery < 1 {
+		secondaryEvery = 1
+	}
+	return &Sampler{
+		strategy:       strategy,
+		sampleSize:     sampleSize,
+		secondaryEvery: secondaryEvery,
+		targets:        targets,
+		rnd:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Strategy returns the name of the sampling strategy
+func (s *Sampler) Strategy() string {
+	return s.strategy
+}
+
+// Next returns the servers to be tested on the next poll
+func (s *Sampler) Next() Servers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := *s.targets
+	poll := s.polls
+	s.polls++
+	if len(targets) <= 1 {
+		return append(Servers{}, targets...)
+	}
+
+	selected := Servers{}
+	switch s.strategy {
+	case StrategyRoundRobin:
+		selected = append(selected, targets[poll%len(targets)])
+	case StrategyRandom:
+		k := s.sampleSize
+		if k > len(targets) {
+			k = len(targets)
+		}
+		for _, i := range s.rnd.Perm(len(targets))[:k] {
+			selected = append(selected, targets[i])
+		}
+	case StrategyPrimary:
+		selected = append(selected, targets[0])
+		if poll%s.secondaryEvery == s.secondaryEvery-1 {
+			selected = append(selected, targets[1+s.secondary%(len(targets)-1)])
+			s.secondary++
+		}
+	default:
+		selected = append(selected, targets...)
+	}
+
+	log.Debugf("Sampling strategy %s selected %d of %d servers", s.strategy, len(selected), len(targets))
+	return selected
+}
@@ -0,0 +1,141 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// payloadSize : size of the content of each upload request of a stream test
+const payloadSize = 4 << 20
+
+// streamTest : download or upload test repeating a request on several
+// parallel streams for a fixed time. The bytes moved during the grace
+// time, while the connections ramp up, are left out of the speed.
+type streamTest struct {
+	streams  int
+	duration time.Duration
+	grace    time.Duration
+}
+
+// run calls request on every stream until the test time is over, or the
+// stream fails. The request must count the bytes it moves in tr, and
+// give up when ctx is done. A stream failing before the end fails the test,
+// even if bytes were moved, as the speed would be wrong.
+func (st streamTest) run(tr *transfer, request func(ctx context.Context) error) (Measurement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), st.duration)
+	defer cancel()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < st.streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := request(ctx); err != nil {
+					if ctx.Err() == nil {
+						tr.fail(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	// The speed is measured from the end of the grace time, or from the
+	// start if the streams finish before
+	start, graceBytes := time.Now(), int64(0)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-time.After(st.grace):
+		start, graceBytes = time.Now(), atomic.LoadInt64(tr.count)
+		<-done
+	case <-done:
+	}
+	elapsed := time.Since(start)
+
+	if tr.err != nil {
+		return Measurement{}, tr.err
+	}
+	moved := atomic.LoadInt64(tr.count) - graceBytes
+	if moved <= 0 || elapsed <= 0 {
+		return Measurement{}, errors.New("no data was transferred")
+	}
+	return Measurement{Speed: float64(moved) * 8 / 1e6 / elapsed.Seconds()}, nil
+}
+
+// get downloads the URL, counting the bytes received
+func (t *transfer) get(ctx context.Context, url string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return t.receive(resp.Body)
+}
+
+// post uploads the content to the URL, counting the bytes sent
+func (t *transfer) post(ctx context.Context, url string, contentType string, content []byte) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", url, counter{bytes.NewReader(content), t.count})
+	if err != nil {
+		return err
+	}
+	request.ContentLength = int64(len(content))
+	request.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// noCache adds a random parameter to the URL, so the responses aren't
+// served from a cache
+func noCache(url string) string {
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return url + sep + "r=" + strconv.FormatInt(rand.Int63(), 36)
+}
+
+var (
+	payloadOnce sync.Once
+	payload     []byte
+)
+
+// randomPayload returns the content of the uploads, random so it can't be
+// compressed
+func randomPayload() []byte {
+	payloadOnce.Do(func() {
+		payload = make([]byte, payloadSize)
+		rand.Read(payload)
+	})
+	return payload
+}
@@ -0,0 +1,152 @@
+package speedtest
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tester runs the speedtests against the servers picked by its sampler,
+// and keeps the latest result. Its settings can be changed while it runs,
+// taking effect on the next test.
+type Tester struct {
+	client    User
+	sampler   *Sampler
+	aggregate string
+	validator Validator
+	baseline  Baseline
+	fallbacks Servers
+
+	running sync.Mutex
+	mu      sync.RWMutex
+	latest  Result
+}
+
+// NewTester creates a Tester for the client, combining the measurements
+// of multiple servers with the aggregate function
+func NewTester(client User, sampler *Sampler, aggregate string) *Tester {
+	return &Tester{
+		client:    client,
+		sampler:   sampler,
+		aggregate: aggregate,
+		validator: DefaultValidator(),
+	}
+}
+
+// SetClient sets the information of the host running the tests
+func (t *Tester) SetClient(client User) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.client = client
+}
+
+// SetSampler sets the sampler that picks the servers of each test
+func (t *Tester) SetSampler(sampler *Sampler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sampler = sampler
+}
+
+// SetAggregate sets the function combining the measurements of multiple
+// servers
+func (t *Tester) SetAggregate(aggregate string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.aggregate = aggregate
+}
+
+// SetValidator sets the validator flagging implausible results, and the
+// previous results they are compared with. baseline can be nil.
+func (t *Tester) SetValidator(validator Validator, baseline Baseline) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.validator = validator
+	t.baseline = baseline
+}
+
+// SetFallbacks sets the servers used to retry suspect results, when
+// none of the other target servers is available
+func (t *Tester) SetFallbacks(servers Servers) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fallbacks = servers
+}
+
+// settings returns a copy of the tester with the current settings, used
+// for a whole test even if they change meanwhile
+func (t *Tester) settings() *Tester {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return &Tester{
+		client:    t.client,
+		sampler:   t.sampler,
+		aggregate: t.aggregate,
+		validator: t.validator,
+		baseline:  t.baseline,
+		fallbacks: t.fallbacks,
+	}
+}
+
+// TestNow runs a speedtest and stores its result as the latest one. Tests
+// are run one at a time, so they don't compete for bandwidth.
+func (t *Tester) TestNow() Result {
+	t.running.Lock()
+	defer t.running.Unlock()
+
+	s := t.settings()
+	selected := s.sampler.Next()
+	result := selected.TestNow(s.client, s.aggregate)
+	s.validator.Check(&result, s.baseline)
+	if result.Quality == QualitySuspect && s.validator.Retry {
+		result = s.retry(selected, result)
+	}
+
+	t.mu.Lock()
+	t.latest = result
+	t.mu.Unlock()
+	return result
+}
+
+// retry tests a server that was not selected in the suspect result. The
+// new result replaces the suspect one only if it passes the validation.
+func (t *Tester) retry(selected Servers, suspect Result) Result {
+	server, ok := t.alternative(selected)
+	if !ok {
+		log.Warn("No other server available to retry the suspect result")
+		return suspect
+	}
+
+	log.Infof("Retrying the suspect result with server [%s]", server.ID)
+	result := Servers{server}.TestNow(t.client, t.aggregate)
+	t.validator.Check(&result, t.baseline)
+	if result.Quality != QualityOK {
+		suspect.Issues = append(suspect.Issues, fmt.Sprintf("retry with server [%s] was %s", server.ID, result.Quality))
+		return suspect
+	}
+	log.Infof("Replaced the suspect result with the one from server [%s]", server.ID)
+	return result
+}
+
+// alternative returns the first target or fallback server that is not in
+// the selected ones
+func (t *Tester) alternative(selected Servers) (Server, bool) {
+	tested := map[string]bool{}
+	for _, s := range selected {
+		tested[s.ID] = true
+	}
+	candidates := append(append(Servers{}, *t.sampler.targets...), t.fallbacks...)
+	for _, s := range candidates {
+		if !tested[s.ID] {
+			return s, true
+		}
+	}
+	return Server{}, false
+}
+
+// Latest returns the result of the latest speedtest
+func (t *Tester) Latest() Result {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.latest
+}
@@ -0,0 +1,94 @@
+package speedtest
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings : breakdown of the time to reach the server, on a new
+// connection. TTFB is the time to the first byte of the response, from
+// the start of the request, so it includes the others.
+type Timings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	TTFB    time.Duration
+}
+
+// Tracer : implemented by the backends able to break down the time to
+// reach their servers. TracePing measures the latency and jitter like
+// Ping, and the timings of its first request, made on a new connection.
+type Tracer interface {
+	TracePing(s Server) (latency, jitter time.Duration, timings Timings, err error)
+}
+
+// requestTrace records the timings of a request
+type requestTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timings      Timings
+}
+
+// attach returns the request with the trace attached, starting the clock
+func (t *requestTrace) attach(request *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.DNS = time.Since(t.dnsStart)
+		},
+		// Several addresses can be dialed at once, the first one to
+		// connect is kept
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.timings.Connect == 0 {
+				t.timings.Connect = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.TLS = time.Since(t.tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.TTFB = time.Since(t.start)
+		},
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.start = time.Now()
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
+
+// result returns the timings recorded
+func (t *requestTrace) result() Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timings
+}
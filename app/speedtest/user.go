@@ -5,6 +5,7 @@ import (
 	"encoding/xml"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -27,7 +28,10 @@ type Users struct {
 func FetchUserInfo() User {
 	// Fetch xml user data
 	resp, err := http.Get("http://speedtest.net/speedtest-config.php")
-	checkError(err)
+	if err != nil {
+		log.Warnf("Cannot fetch user information: %s", err)
+		return User{}
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	checkError(err)
 	defer resp.Body.Close()
@@ -58,3 +62,15 @@ func (u *User) Show() {
 		log.Infof("Testing From IP: %s (%s) [%s, %s]", u.IP, u.Isp, u.Lat, u.Lon)
 	}
 }
+
+// Info returns the client information reported in the results
+func (u User) Info() ClientInfo {
+	lat, _ := strconv.ParseFloat(u.Lat, 64)
+	lon, _ := strconv.ParseFloat(u.Lon, 64)
+	return ClientInfo{
+		IP:  u.IP,
+		ISP: u.Isp,
+		Lat: lat,
+		Lon: lon,
+	}
+}
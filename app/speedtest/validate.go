@@ -0,0 +1,96 @@
+package speedtest
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Quality flags of a result. Alerts and statistics only consider results
+// flagged as QualityOK.
+const (
+	QualityOK      = "ok"
+	QualitySuspect = "suspect"
+	QualityFailed  = "failed"
+)
+
+// Baseline provides the previous results, used to detect implausible
+// measurements
+type Baseline interface {
+	Results() []Result
+}
+
+// Validator flags implausible results
+type Validator struct {
+	// MaxRatio : maximum ratio between download and upload speeds
+	MaxRatio float64
+	// MaxSpeedFactor : maximum ratio between a speed and its median in
+	// the previous good results
+	MaxSpeedFactor float64
+	// MinBaseline : number of previous good results needed before
+	// comparing speeds with them
+	MinBaseline int
+	// Retry : retry suspect results against another server
+	Retry bool
+}
+
+// DefaultValidator returns a Validator with the default limits
+func DefaultValidator() Validator {
+	return Validator{
+		MaxRatio:       100,
+		MaxSpeedFactor: 10,
+		MinBaseline:    5,
+	}
+}
+
+// Check sets the quality flag of the result, listing the reasons why it
+// seems to be wrong
+func (v Validator) Check(result *Result, baseline Baseline) {
+	result.Quality = QualityOK
+	result.Issues = nil
+	if result.Error != "" {
+		result.Quality = QualityFailed
+		return
+	}
+
+	for _, s := range result.Servers {
+		if s.Error != "" {
+			continue
+		}
+		if v.MaxRatio > 0 && (s.DownloadBps*v.MaxRatio < s.UploadBps || s.DownloadBps > s.UploadBps*v.MaxRatio) {
+			result.Issues = append(result.Issues, fmt.Sprintf("[%s] download and upload speeds differ by more than %gx", s.ID, v.MaxRatio))
+		}
+		if s.BytesReceived == 0 {
+			result.Issues = append(result.Issues, fmt.Sprintf("[%s] no bytes received", s.ID))
+		}
+		if s.BytesSent == 0 {
+			result.Issues = append(result.Issues, fmt.Sprintf("[%s] no bytes sent", s.ID))
+		}
+		if s.WarmUpOnly {
+			result.Issues = append(result.Issues, fmt.Sprintf("[%s] measured during warm-up only", s.ID))
+		}
+	}
+
+	if baseline != nil && v.MaxSpeedFactor > 0 {
+		dl, ul := []float64{}, []float64{}
+		for _, r := range baseline.Results() {
+			if r.Quality == QualityOK {
+				dl = append(dl, r.DownloadBps)
+				ul = append(ul, r.UploadBps)
+			}
+		}
+		if len(dl) >= v.MinBaseline {
+			if median := median(dl); median > 0 && result.DownloadBps > median*v.MaxSpeedFactor {
+				result.Issues = append(result.Issues, fmt.Sprintf("download speed is more than %gx the usual %.2f Mbit/s", v.MaxSpeedFactor, median/1e6))
+			}
+			if median := median(ul); median > 0 && result.UploadBps > median*v.MaxSpeedFactor {
+				result.Issues = append(result.Issues, fmt.Sprintf("upload speed is more than %gx the usual %.2f Mbit/s", v.MaxSpeedFactor, median/1e6))
+			}
+		}
+	}
+
+	if len(result.Issues) > 0 {
+		result.Quality = QualitySuspect
+		log.Warnf("Warning: Result seems to be wrong (%v). Please speedtest again.", result.Issues)
+	}
+}
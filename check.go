@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	configuration "github.com/speedtest-monitor/app/configuration"
+	"github.com/speedtest-monitor/app/speedtest"
+)
+
+// Exit codes of the run command. The threshold codes are combined when
+// several measurements are out of their threshold, e.g. 6 for both the
+// download and upload speeds.
+const (
+	exitOK       = 0
+	exitFailed   = 1
+	exitDownload = 2
+	exitUpload   = 4
+	exitLatency  = 8
+	exitTimings  = 16
+)
+
+// Exit codes of the Nagios plugin format
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+// formatNagios : output format of the run command for Nagios and Icinga
+// checks
+const formatNagios = "nagios"
+
+// exitCode returns the exit code of the run command for the result,
+// according to the thresholds of the configuration
+func exitCode(result speedtest.Result) int {
+	if result.Quality == speedtest.QualityFailed {
+		return exitFailed
+	}
+	code := exitOK
+	if result.DownloadMbps() < config.DownloadThreshold {
+		code |= exitDownload
+	}
+	if result.UploadMbps() < config.UploadThreshold {
+		code |= exitUpload
+	}
+	if config.LatencyThreshold > 0 && result.PingMs > config.LatencyThreshold {
+		code |= exitLatency
+	}
+	for _, t := range timings(result, config) {
+		if t.exceeded() {
+			code |= exitTimings
+		}
+	}
+	return code
+}
+
+// timing : connection timing of a result, in ms, with its threshold
+type timing struct {
+	name      string
+	label     string
+	value     float64
+	threshold float64
+}
+
+// timings returns the connection timings of the result, with the
+// thresholds of the configuration
+func timings(result speedtest.Result, conf *configuration.Configuration) []timing {
+	return []timing{
+		{"DNS lookup", "dns", result.DNSMs, conf.DNSThreshold},
+		{"TCP connect", "connect", result.ConnectMs, conf.ConnectThreshold},
+		{"TLS handshake", "tls", result.TLSMs, conf.TLSThreshold},
+		{"time to first byte", "ttfb", result.TTFBMs, conf.TTFBThreshold},
+	}
+}
+
+// exceeded returns whether the timing is higher than its threshold, if any
+func (t timing) exceeded() bool {
+	return t.threshold > 0 && t.value > t.threshold
+}
+
+// writeNagios writes the result as the output of a Nagios plugin, with
+// perfdata, and returns the plugin exit code. Measurements out of their
+// threshold are critical, and suspect results are a warning.
+func writeNagios(w io.Writer, result speedtest.Result) int {
+	if result.Quality == speedtest.QualityFailed {
+		fmt.Fprintf(w, "SPEEDTEST UNKNOWN - %s\n", result.Error)
+		return nagiosUnknown
+	}
+
+	status, label := nagiosOK, "OK"
+	problems := []string{}
+	code := exitCode(result)
+	if code&exitDownload != 0 {
+		problems = append(problems, fmt.Sprintf("download lower than %v Mbit/s", config.DownloadThreshold))
+	}
+	if code&exitUpload != 0 {
+		problems = append(problems, fmt.Sprintf("upload lower than %v Mbit/s", config.UploadThreshold))
+	}
+	if code&exitLatency != 0 {
+		problems = append(problems, fmt.Sprintf("ping higher than %v ms", config.LatencyThreshold))
+	}
+	for _, t := range timings(result, config) {
+		if t.exceeded() {
+			problems = append(problems, fmt.Sprintf("%s higher than %v ms", t.name, t.threshold))
+		}
+	}
+	if len(problems) > 0 {
+		status, label = nagiosCritical, "CRITICAL"
+	} else if result.Quality == speedtest.QualitySuspect {
+		status, label = nagiosWarning, "WARNING"
+		problems = append(problems, "suspect result: "+strings.Join(result.Issues, ", "))
+	}
+
+	summary := fmt.Sprintf("Download %.2f Mbit/s, Upload %.2f Mbit/s, Ping %.2f ms", result.DownloadMbps(), result.UploadMbps(), result.PingMs)
+	if len(problems) > 0 {
+		summary += " (" + strings.Join(problems, ", ") + ")"
+	}
+	perf := []string{
+		perfdata("download", result.DownloadMbps(), "", minimum(config.DownloadThreshold)),
+		perfdata("upload", result.UploadMbps(), "", minimum(config.UploadThreshold)),
+		perfdata("ping", result.PingMs, "ms", maximum(config.LatencyThreshold)),
+		perfdata("jitter", result.JitterMs, "ms", ""),
+	}
+	for _, t := range timings(result, config) {
+		perf = append(perf, perfdata(t.label, t.value, "ms", maximum(t.threshold)))
+	}
+	fmt.Fprintf(w, "SPEEDTEST %s - %s | %s\n", label, summary, strings.Join(perf, " "))
+	return status
+}
+
+// perfdata formats a Nagios performance value with its critical range
+func perfdata(label string, value float64, unit string, critical string) string {
+	return fmt.Sprintf("%s=%.3f%s;;%s;0;", label, value, unit, critical)
+}
+
+// minimum returns the Nagios range alerting on values lower than the
+// threshold, or an empty range if it's 0
+func minimum(threshold float64) string {
+	if threshold <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v:", threshold)
+}
+
+// maximum returns the Nagios range alerting on values higher than the
+// threshold, or an empty range if it's 0
+func maximum(threshold float64) string {
+	if threshold <= 0 {
+		return ""
+	}
+	return fmt.Sprint(threshold)
+}
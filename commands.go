@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	configuration "github.com/speedtest-monitor/app/configuration"
+	"github.com/speedtest-monitor/app/export"
+	"github.com/speedtest-monitor/app/history"
+	"github.com/speedtest-monitor/app/resolver"
+	"github.com/speedtest-monitor/app/server/endpoint"
+	"github.com/speedtest-monitor/app/speedtest"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var qualities = []string{speedtest.QualityOK, speedtest.QualitySuspect, speedtest.QualityFailed}
+
+var (
+	// legacyCmd keeps the behaviour from before the commands, picking run or
+	// serve from the serverMode key
+	legacyCmd = kingpin.Command("legacy", "Run or serve depending on serverMode").Default().Hidden()
+
+	runCmd    = kingpin.Command("run", "Run a single speed test")
+	runFormat = runCmd.Flag("format", "Write the result to the standard output in this format, besides the logs in the standard error").Short('f').Enum(export.FormatText, export.FormatJSON, export.FormatCSV, export.FormatTSV, formatNagios)
+
+	serveCmd  = kingpin.Command("serve", "Test periodically and serve the results through HTTP")
+	listenOpt = serveCmd.Flag("listen", "Address to listen on").Default(":8080").Envar("SPEEDTEST_LISTEN").String()
+
+	endpointCmd    = kingpin.Command("serve-endpoint", "Serve the speedtest.net test endpoints, to be tested against by other instances")
+	endpointListen = endpointCmd.Flag("listen", "Address to listen on").Default(":8081").Envar("SPEEDTEST_ENDPOINT_LISTEN").String()
+
+	serversCmd    = kingpin.Command("servers", "List the servers of the backend, nearest first")
+	serversSearch = serversCmd.Flag("search", "Only list the servers whose name, country or sponsor contain this text").String()
+	serversLimit  = serversCmd.Flag("limit", "Maximum number of servers listed, 0 for all").Default("20").Int()
+
+	historyCmd     = kingpin.Command("history", "Show the results stored in the history file")
+	historySince   = historyCmd.Flag("since", "Only show the results of this last period, e.g. 24h").Duration()
+	historyQuality = historyCmd.Flag("quality", "Only show the results of this quality").Enum(qualities...)
+	historyLast    = historyCmd.Flag("last", "Only show this number of latest results, 0 for all").Default("20").Int()
+	historyFormat  = historyCmd.Flag("format", "Output format").Default(export.FormatText).Enum(export.Formats...)
+
+	exportCmd     = kingpin.Command("export", "Export the results stored in the history file")
+	exportSince   = exportCmd.Flag("since", "Only export the results of this last period, e.g. 720h").Duration()
+	exportQuality = exportCmd.Flag("quality", "Only export the results of this quality").Enum(qualities...)
+	exportFormat  = exportCmd.Flag("format", "Output format").Default(export.FormatCSV).Enum(export.Formats...)
+	exportOutput  = exportCmd.Flag("output", "File to write, standard output if empty").Short('o').String()
+
+	reportCmd    = kingpin.Command("report", "Summarize the results stored in the history file")
+	reportSince  = reportCmd.Flag("since", "Period summarized, e.g. 168h for the last week").Default("24h").Duration()
+	reportFormat = reportCmd.Flag("format", "Output format").Default(export.FormatText).Enum(export.FormatText, export.FormatJSON)
+
+	resolversCmd    = kingpin.Command("resolvers", "Probe the DNS resolvers once, storing the probe in the resolver file if any")
+	resolversHosts  = resolversCmd.Arg("hosts", "Hostnames to resolve, the resolverHosts of the configuration if empty").Strings()
+	resolversFormat = resolversCmd.Flag("format", "Output format").Default(export.FormatText).Enum(export.FormatText, export.FormatJSON)
+
+	watchCmd     = kingpin.Command("watch", "Show a dashboard of a running instance on the terminal")
+	watchURL     = watchCmd.Flag("url", "URL of the instance").Default("http://localhost:8080").Envar("SPEEDTEST_URL").String()
+	watchRefresh = watchCmd.Flag("refresh", "Time between each refresh").Default("5s").Duration()
+
+	configCmd         = kingpin.Command("config", "Inspect the configuration")
+	configShowCmd     = configCmd.Command("show", "Print the effective configuration, with secrets redacted")
+	configValidateCmd = configCmd.Command("validate", "Validate a configuration file, with the flags and environment variables")
+	configValidateArg = configValidateCmd.Arg("file", "Configuration file to validate, the one given by --config or found in the search paths if empty").String()
+)
+
+// openHistory stores the results in the history file of the configuration,
+// if any
+func openHistory(results *history.History, conf *configuration.Configuration) {
+	if conf.HistoryFile == "" {
+		results.Close()
+		return
+	}
+	if err := results.Open(conf.HistoryFile); err != nil {
+		log.Errorf("Results won't be stored: %s", err)
+	}
+}
+
+// openProbes stores the DNS resolver probes in the file of the
+// configuration, if any
+func openProbes(probes *history.Probes, conf *configuration.Configuration) {
+	if conf.ResolverFile == "" {
+		probes.Close()
+		return
+	}
+	if err := probes.Open(conf.ResolverFile); err != nil {
+		log.Errorf("DNS resolver probes won't be stored: %s", err)
+	}
+}
+
+// readHistory reads the results of the history file since the given
+// period, of the given quality
+func readHistory(since time.Duration, quality string) []speedtest.Result {
+	if config.HistoryFile == "" {
+		kingpin.Fatalf("no history file, set historyFile to store the results")
+	}
+	results, err := history.ReadFile(config.HistoryFile)
+	kingpin.FatalIfError(err, "")
+	var from time.Time
+	if since > 0 {
+		from = time.Now().Add(-since)
+	}
+	return history.Filter(results, from, quality)
+}
+
+// newTester fetches the client information and the server list, and
+// creates a tester for the servers of the configuration. It returns the
+// client information as reported by speedtest.net too, while the tester
+// uses the one reported by the servers of the backend if it can.
+func newTester() (speedtest.User, speedtest.ServerList, *speedtest.Tester) {
+	reported := speedtest.FetchUserInfo()
+	user := reported
+	setLocation(&user, config)
+
+	list, err := speedtest.FetchServers(config.Backend, user)
+	kingpin.FatalIfError(err, "")
+	user = list.ReportedClient(user)
+	user.Show()
+	targets := list.FindServer(config.Servers)
+	sampler, err := newSampler(config, &targets)
+	kingpin.FatalIfError(err, "invalid sampling configuration")
+	tester := speedtest.NewTester(user, sampler, config.Aggregate)
+	tester.SetFallbacks(nearest(list.Servers, 5))
+	return reported, list, tester
+}
+
+// runTest runs a single speed test, storing its result in the history
+// file if any, and writing it to the standard output in the given format.
+// It returns the exit code for the result, see exitCode and writeNagios.
+func runTest(format string) int {
+	_, _, tester := newTester()
+	results := history.NewHistory(config.HistorySize)
+	openHistory(results, config)
+	defer results.Close()
+	tester.SetValidator(newValidator(config), results)
+	stopProgress := startProgress()
+	result := tester.TestNow()
+	stopProgress()
+	results.Add(result)
+	switch format {
+	case "":
+	case formatNagios:
+		return writeNagios(os.Stdout, result)
+	default:
+		kingpin.FatalIfError(export.WriteResult(os.Stdout, result, format), "")
+	}
+	return exitCode(result)
+}
+
+// serve tests periodically and serves the results through HTTP
+func serve() {
+	reported, list, tester := newTester()
+	startServer(newMonitor(config, reported, list, tester))
+}
+
+// serveEndpoint serves the test endpoints until the process is stopped
+func serveEndpoint() {
+	log.Infof("Serving the test endpoints on %s", *endpointListen)
+	server := http.Server{
+		Addr:           *endpointListen,
+		Handler:        endpoint.NewHandler(),
+		ReadTimeout:    900 * time.Second,
+		WriteTimeout:   900 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	kingpin.FatalIfError(server.ListenAndServe(), "")
+}
+
+// listServers prints the servers matching the search, nearest first
+func listServers() {
+	user := speedtest.FetchUserInfo()
+	setLocation(&user, config)
+	list, err := speedtest.FetchServers(config.Backend, user)
+	kingpin.FatalIfError(err, "")
+	list = list.Filter(*serversSearch, *serversLimit)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tDISTANCE\tNAME\tCOUNTRY\tSPONSOR")
+	for _, s := range list.Servers {
+		fmt.Fprintf(writer, "%s\t%.2f km\t%s\t%s\t%s\n", s.ID, s.Distance, s.Name, s.Country, s.Sponsor)
+	}
+	writer.Flush()
+}
+
+// showHistory prints the latest results of the history file
+func showHistory() {
+	results := readHistory(*historySince, *historyQuality)
+	if *historyLast > 0 && len(results) > *historyLast {
+		results = results[len(results)-*historyLast:]
+	}
+	kingpin.FatalIfError(export.Write(os.Stdout, results, *historyFormat), "")
+}
+
+// exportHistory writes the results of the history file to a file or the
+// standard output
+func exportHistory() {
+	results := readHistory(*exportSince, *exportQuality)
+	output := os.Stdout
+	if *exportOutput != "" {
+		file, err := os.Create(*exportOutput)
+		kingpin.FatalIfError(err, "")
+		defer file.Close()
+		output = file
+	}
+	kingpin.FatalIfError(export.Write(output, results, *exportFormat), "")
+	if *exportOutput != "" {
+		log.Infof("Exported %d results to %s", len(results), *exportOutput)
+	}
+}
+
+// showReport prints a summary of the results of the history file
+func showReport() {
+	report := history.NewReport(readHistory(*reportSince, ""), config.DownloadThreshold, config.UploadThreshold)
+	if *reportFormat == export.FormatJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		kingpin.FatalIfError(err, "")
+		fmt.Println(string(data))
+		return
+	}
+
+	if report.Tests == 0 {
+		fmt.Printf("No results in the last %s\n", *reportSince)
+		return
+	}
+	fmt.Printf("Results from %s to %s\n", report.From.Local().Format("2006-01-02 15:04"), report.To.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("Tests: %d (%d ok, %d suspect, %d failed)\n\n", report.Tests, report.OK, report.Suspect, report.Failed)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "\tMIN\tMEAN\tMEDIAN\tMAX\t")
+	for _, row := range []struct {
+		name  string
+		stats history.Stats
+	}{
+		{"Download (Mbit/s)", report.DownloadMbps},
+		{"Upload (Mbit/s)", report.UploadMbps},
+		{"Ping (ms)", report.PingMs},
+		{"Jitter (ms)", report.JitterMs},
+	} {
+		fmt.Fprintf(writer, "%s\t%.2f\t%.2f\t%.2f\t%.2f\t\n", row.name, row.stats.Min, row.stats.Mean, row.stats.Median, row.stats.Max)
+	}
+	writer.Flush()
+	fmt.Printf("\nBelow the download threshold (%v Mbit/s): %d\n", config.DownloadThreshold, report.BelowDownload)
+	fmt.Printf("Below the upload threshold (%v Mbit/s): %d\n", config.UploadThreshold, report.BelowUpload)
+}
+
+// probeResolvers probes the DNS resolvers once and prints the lookups. It
+// returns exitFailed if any lookup failed.
+func probeResolvers() int {
+	hosts := *resolversHosts
+	if len(hosts) == 0 {
+		hosts = config.ResolverHosts
+	}
+	if len(hosts) == 0 {
+		kingpin.Fatalf("no hosts to resolve, give them as arguments or set resolverHosts")
+	}
+	probes := history.NewProbes(config.HistorySize)
+	openProbes(probes, config)
+	defer probes.Close()
+	probe := resolver.NewProber(config.Resolvers, hosts).Run()
+	probes.Add(probe)
+
+	if *resolversFormat == export.FormatJSON {
+		data, err := json.MarshalIndent(probe, "", "  ")
+		kingpin.FatalIfError(err, "")
+		fmt.Println(string(data))
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "RESOLVER\tHOST\tLATENCY\tANSWER\t")
+		for _, l := range probe.Lookups {
+			answer := strings.Join(l.Addresses, " ")
+			if l.Failed() {
+				answer = "error: " + l.Error
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%.2f ms\t%s\t\n", l.Resolver, l.Host, l.LatencyMs, answer)
+		}
+		writer.Flush()
+	}
+	if probe.Failures() > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// validateConfiguration checks the configuration file given as argument,
+// or the one in use, with the flags and environment variables
+func validateConfiguration() {
+	if *configValidateArg != "" {
+		*configOpt = *configValidateArg
+	}
+	conf, err := readConfiguration()
+	kingpin.FatalIfError(err, "")
+	if conf.Path() == "" {
+		fmt.Println("No config file found, the default configuration is valid")
+		return
+	}
+	fmt.Printf("Configuration in %s is valid\n", conf.Path())
+}
@@ -2,16 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	configuration "github.com/speedtest-monitor/app/configuration"
 	"github.com/speedtest-monitor/app/server/router"
-	"github.com/speedtest-monitor/app/slack"
 	"github.com/speedtest-monitor/app/speedtest"
 	log "github.com/sirupsen/logrus"
 
@@ -24,53 +26,192 @@ func setTimeout() {
 	}
 }
 
+// registerConfigFlags adds a flag for every configuration key, which can
+// also be set through its environment variable
+func registerConfigFlags() {
+	for _, key := range configuration.Keys() {
+		configFlags[key.Name] = kingpin.Flag(key.Flag, key.Help).Envar(key.Envar).String()
+	}
+}
+
+// readConfiguration loads the configuration file and applies the values
+// from flags and environment variables on top of it
+func readConfiguration() (*configuration.Configuration, error) {
+	conf, err := configuration.LoadConfiguration(*configOpt)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.ApplyOverrides(configOverrides()); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// setLogLevel sets the logging level of the configuration
+func setLogLevel(conf *configuration.Configuration) {
+	if level, err := log.ParseLevel(conf.LoggingLevel); err == nil {
+		log.SetLevel(level)
+	}
+}
+
+// configOverrides returns the configuration values set through flags or
+// environment variables, by key. The deprecated --server flag takes
+// precedence over --servers.
+func configOverrides() map[string]string {
+	overrides := map[string]string{}
+	for name, value := range configFlags {
+		if *value != "" {
+			overrides[name] = *value
+		}
+	}
+	if len(*serverIds) > 0 {
+		ids := make([]string, len(*serverIds))
+		for i, id := range *serverIds {
+			ids[i] = strconv.Itoa(id)
+		}
+		overrides["servers"] = strings.Join(ids, ",")
+	}
+	return overrides
+}
+
+// printConfiguration prints the effective configuration as JSON, with
+// the secrets redacted
+func printConfiguration() {
+	data, err := json.MarshalIndent(config.Redacted(), "", "  ")
+	kingpin.FatalIfError(err, "")
+	fmt.Println(string(data))
+}
+
+// registerBackends registers the backends with the settings of the
+// configuration
+func registerBackends(conf *configuration.Configuration) {
+	speedtest.RegisterBackend(speedtest.Legacy{URLs: conf.SpeedtestServers})
+	speedtest.RegisterBackend(speedtest.LibreSpeed{ServerList: conf.LibreSpeedServers})
+	speedtest.RegisterBackend(speedtest.Iperf3{Addresses: conf.Iperf3Servers})
+	speedtest.RegisterBackend(speedtest.HTTP{
+		DownloadURL: conf.HTTPDownloadURL,
+		UploadURL:   conf.HTTPUploadURL,
+		PingURL:     conf.HTTPPingURL,
+		PingMethod:  conf.HTTPPingMethod,
+	})
+}
+
+// setLocation overrides the coordinates reported by speedtest.net with the
+// ones defined in the configuration, if any
+func setLocation(user *speedtest.User, conf *configuration.Configuration) {
+	if conf.Latitude != nil && conf.Longitude != nil {
+		user.SetLocation(*conf.Latitude, *conf.Longitude)
+		return
+	}
+	if conf.City != "" {
+		lat, lon, ok := speedtest.LookupCity(conf.City)
+		if !ok {
+			log.Warnf("Unknown city %q, using the location reported by speedtest.net", conf.City)
+			return
+		}
+		user.SetLocation(lat, lon)
+	}
+}
+
 var (
-	showList      = kingpin.Flag("list", "Show available speedtest.net servers").Short('l').Bool()
-	serverIds     = kingpin.Flag("server", "Select server id to speedtest").Short('s').Ints()
-	timeoutOpt    = kingpin.Flag("timeout", "Define timeout seconds. Default: 10 sec").Short('t').Int()
-	timeout       = 10
-	serviceName   = "Speed Test"
-	port          = "8080"
-	latestResults = &speedtest.LatestResult{}
-	config        = configuration.LoadConfiguration()
+	configOpt   = kingpin.Flag("config", "Path of the configuration file").Envar("SPEEDTEST_CONFIG").String()
+	showList    = kingpin.Flag("list", "Show available speedtest.net servers (deprecated, use the servers command)").Short('l').Bool()
+	serverIds   = kingpin.Flag("server", "Select server id to speedtest").Short('s').Ints()
+	timeoutOpt  = kingpin.Flag("timeout", "Define timeout seconds. Default: 10 sec").Short('t').Int()
+	printConfig = kingpin.Flag("print-config", "Print the effective configuration, with secrets redacted, and exit").Bool()
+	configFlags = map[string]*string{}
+	timeout     = 10
+	serviceName = "Speed Test"
+	config      *configuration.Configuration
 )
 
 func main() {
 	kingpin.Version("1.0.3")
-	kingpin.Parse()
-
-	setTimeout()
-
-	if config.LoggingLevel == "debug" {
-		log.SetLevel(log.DebugLevel)
+	// Keep the standard output for the results
+	log.SetOutput(os.Stderr)
+	registerConfigFlags()
+	command := kingpin.Parse()
+	if command == configValidateCmd.FullCommand() {
+		validateConfiguration()
+		return
 	}
 
-	user := speedtest.FetchUserInfo()
-	user.Show()
-
-	list := speedtest.FetchServerList(user)
-	if *showList {
-		list.Show()
+	var err error
+	config, err = readConfiguration()
+	kingpin.FatalIfError(err, "")
+	if *printConfig {
+		printConfiguration()
 		return
 	}
+	setTimeout()
+	setLogLevel(config)
+	registerBackends(config)
 
-	targets := list.FindServer(*serverIds)
-	if config.ServerMode == true {
-		startServer(&targets, latestResults, config)
-	} else {
-		targets.TestNow(latestResults)
+	switch command {
+	case runCmd.FullCommand():
+		os.Exit(runTest(*runFormat))
+	case serveCmd.FullCommand():
+		serve()
+	case endpointCmd.FullCommand():
+		serveEndpoint()
+	case serversCmd.FullCommand():
+		listServers()
+	case historyCmd.FullCommand():
+		showHistory()
+	case exportCmd.FullCommand():
+		exportHistory()
+	case reportCmd.FullCommand():
+		showReport()
+	case resolversCmd.FullCommand():
+		os.Exit(probeResolvers())
+	case watchCmd.FullCommand():
+		watch(*watchURL, *watchRefresh)
+	case configShowCmd.FullCommand():
+		printConfiguration()
+	case legacyCmd.FullCommand():
+		if *showList {
+			user := speedtest.FetchUserInfo()
+			setLocation(&user, config)
+			list, err := speedtest.FetchServers(config.Backend, user)
+			kingpin.FatalIfError(err, "")
+			list.Show()
+		} else if config.ServerMode {
+			serve()
+		} else {
+			runTest("")
+		}
 	}
 }
 
-func startServer(targets *speedtest.Servers, latestResults *speedtest.LatestResult, config *configuration.Configuration) {
-	router := router.NewRouter(targets, latestResults)
-	var sc *slack.SlackClient
-	if config.SlackEndpoint != "" {
-		sc = slack.NewSlackClient(config)
+// nearest returns up to n servers of the list, sorted by distance
+func nearest(servers speedtest.Servers, n int) speedtest.Servers {
+	if len(servers) < n {
+		return servers
 	}
+	return servers[:n]
+}
+
+// newValidator creates the validator flagging implausible results, with
+// the limits from the configuration
+func newValidator(conf *configuration.Configuration) speedtest.Validator {
+	validator := speedtest.DefaultValidator()
+	validator.MaxRatio = conf.MaxSpeedRatio
+	validator.MaxSpeedFactor = conf.MaxSpeedFactor
+	validator.Retry = conf.RetrySuspect
+	return validator
+}
+
+// newSampler creates the sampler that picks the servers tested on each
+// poll, with the strategy from the configuration
+func newSampler(conf *configuration.Configuration, targets *speedtest.Servers) (*speedtest.Sampler, error) {
+	return speedtest.NewSampler(conf.Strategy, targets, conf.SampleSize, conf.SecondaryEvery)
+}
+
+func startServer(m *monitor) {
+	router := router.NewRouter(m.tester, m.results, m.probes, m, m)
 	// Create a new server and set timeout values.
 	server := http.Server{
-		Addr:           ":" + port,
+		Addr:           *listenOpt,
 		Handler:        router,
 		ReadTimeout:    900 * time.Second,
 		WriteTimeout:   900 * time.Second,
@@ -83,20 +224,18 @@ func startServer(targets *speedtest.Servers, latestResults *speedtest.LatestResu
 
 	// Start the listener.
 	go func() {
+		config, _ := m.current()
 		log.Infof("%s running!", config.AppName)
-		if config.SlackEndpoint != "" {
-			sc.AddMessage(fmt.Sprintf("Running %s", config.AppName))
-			sc.SendMessages()
-		}
+		m.notify(fmt.Sprintf("Running %s", config.AppName), false)
 		log.Infof("Listener closed : %v", server.ListenAndServe())
-		if config.SlackEndpoint != "" {
-			sc.AddMessage(fmt.Sprintf("Shutting down %s", config.AppName))
-			sc.SendMessages()
-		}
+		config, _ = m.current()
+		m.notify(fmt.Sprintf("Shutting down %s", config.AppName), false)
 		wg.Done()
 	}()
 
-	startPoller(targets, sc)
+	m.watchConfiguration()
+	m.startProber()
+	m.startPoller()
 	// Listen for an interrupt signal from the OS.
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt)
@@ -133,34 +272,3 @@ func startServer(targets *speedtest.Servers, latestResults *speedtest.LatestResu
 	// Wait for the listener to report it is closed.
 	wg.Wait()
 }
-
-func testNow(targets *speedtest.Servers, sc *slack.SlackClient) {
-	targets.TestNow(latestResults)
-	if config.SlackEndpoint != "" {
-		if latestResults.DownSpeed < config.DownloadThreshold {
-			sc.AddAlert(fmt.Sprintf("Current Download speed (%s) lower than %v", latestResults.DownSpeedStr, config.DownloadThreshold))
-		}
-		if latestResults.UpSpeed < config.UploadThreshold {
-			sc.AddAlert(fmt.Sprintf("Current Upload speed (%s) lower than %v", latestResults.UpSpeedStr, config.UploadThreshold))
-		}
-		if len(sc.Messages) > 0 {
-			go sc.SendMessages()
-		}
-	}
-}
-
-func startPoller(targets *speedtest.Servers, sc *slack.SlackClient) {
-	testNow(targets, sc)
-	go func() {
-		interval := config.Interval
-		pollPeriod := time.Second * time.Duration(interval)
-		for {
-			log.Debugf("Waiting %d seconds before next poll.", interval)
-
-			select {
-			case <-time.After(pollPeriod):
-				go testNow(targets, sc)
-			}
-		}
-	}()
-}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	configuration "github.com/speedtest-monitor/app/configuration"
+	"github.com/speedtest-monitor/app/history"
+	"github.com/speedtest-monitor/app/resolver"
+	"github.com/speedtest-monitor/app/server/handlers"
+	"github.com/speedtest-monitor/app/slack"
+	"github.com/speedtest-monitor/app/speedtest"
+)
+
+// reloadDelay : time to wait for a config file to stop changing before
+// reloading it
+const reloadDelay = time.Second
+
+// monitor keeps the state of the server mode. The configuration and
+// everything built from it can be replaced while it runs, without losing
+// the history or restarting the HTTP listener.
+type monitor struct {
+	mu     sync.RWMutex
+	config *configuration.Configuration
+	sc     *slack.SlackClient
+	user   speedtest.User
+
+	// applyMu serializes the changes of configuration, from reloads and
+	// the API, and guards the server list
+	applyMu sync.Mutex
+	list    speedtest.ServerList
+
+	tester  *speedtest.Tester
+	results *history.History
+	prober  *resolver.Prober
+	probes  *history.Probes
+
+	// reset restarts the wait for the next poll, and probeReset the wait
+	// for the next DNS resolver probe
+	reset      chan struct{}
+	probeReset chan struct{}
+
+	testing        bool
+	nextTest       time.Time
+	alerts         []string
+	resolverAlerts []string
+	alertLog       []handlers.Alert
+}
+
+// alertLogSize : number of alerts kept for the dashboard
+const alertLogSize = 100
+
+// newMonitor creates the monitor for the server mode. user is the client
+// information as reported by speedtest.net, before overriding its location.
+func newMonitor(conf *configuration.Configuration, user speedtest.User, list speedtest.ServerList, tester *speedtest.Tester) *monitor {
+	m := &monitor{
+		config:     conf,
+		user:       user,
+		list:       list,
+		tester:     tester,
+		results:    history.NewHistory(conf.HistorySize),
+		prober:     resolver.NewProber(conf.Resolvers, conf.ResolverHosts),
+		probes:     history.NewProbes(conf.HistorySize),
+		reset:      make(chan struct{}, 1),
+		probeReset: make(chan struct{}, 1),
+	}
+	openHistory(m.results, conf)
+	openProbes(m.probes, conf)
+	tester.SetValidator(newValidator(conf), m.results)
+	if conf.SlackEndpoint != "" {
+		m.sc = slack.NewSlackClient(conf)
+	}
+	return m
+}
+
+// current returns the configuration and Slack client in use
+func (m *monitor) current() (*configuration.Configuration, *slack.SlackClient) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config, m.sc
+}
+
+// Config returns the configuration in use
+func (m *monitor) Config() *configuration.Configuration {
+	config, _ := m.current()
+	return config
+}
+
+// UpdateConfig applies a configuration changed through the API, writing
+// the changed keys back to the config file if persistConfig is enabled
+func (m *monitor) UpdateConfig(conf *configuration.Configuration, keys []string) error {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	if conf.PersistConfig {
+		if err := conf.Persist(keys); err != nil {
+			return fmt.Errorf("cannot persist the configuration: %s", err)
+		}
+		log.Infof("Configuration persisted to %s", conf.Path())
+	}
+	m.replace(conf)
+	return nil
+}
+
+// notify sends a message through Slack, if configured
+func (m *monitor) notify(message string, isAlert bool) {
+	_, sc := m.current()
+	if sc == nil {
+		return
+	}
+	if isAlert {
+		sc.AddAlert(message)
+	} else {
+		sc.AddMessage(message)
+	}
+	sc.SendMessages()
+}
+
+// alertsFor returns the alerts raised by a result. Suspect results don't
+// raise alerts.
+func alertsFor(result speedtest.Result, config *configuration.Configuration) []string {
+	alerts := []string{}
+	switch result.Quality {
+	case speedtest.QualitySuspect:
+		log.Warnf("Ignoring suspect result in alerts: %v", result.Issues)
+		return alerts
+	case speedtest.QualityFailed:
+		return append(alerts, fmt.Sprintf("Speed test failed: %s", result.Error))
+	}
+	legacy := result.Legacy()
+	if result.DownloadMbps() < config.DownloadThreshold {
+		alerts = append(alerts, fmt.Sprintf("Current Download speed (%s) lower than %v", legacy.DownSpeedStr, config.DownloadThreshold))
+	}
+	if result.UploadMbps() < config.UploadThreshold {
+		alerts = append(alerts, fmt.Sprintf("Current Upload speed (%s) lower than %v", legacy.UpSpeedStr, config.UploadThreshold))
+	}
+	if config.LatencyThreshold > 0 && result.PingMs > config.LatencyThreshold {
+		alerts = append(alerts, fmt.Sprintf("Current Ping (%.2f ms) higher than %v ms", result.PingMs, config.LatencyThreshold))
+	}
+	for _, t := range timings(result, config) {
+		if t.exceeded() {
+			alerts = append(alerts, fmt.Sprintf("Current %s (%.2f ms) higher than %v ms", t.name, t.value, t.threshold))
+		}
+	}
+	return alerts
+}
+
+// resolverAlertsFor returns the alerts raised by a DNS resolver probe
+func resolverAlertsFor(probe resolver.Probe, config *configuration.Configuration) []string {
+	alerts := []string{}
+	for _, l := range probe.Lookups {
+		switch {
+		case l.Failed():
+			alerts = append(alerts, fmt.Sprintf("DNS resolver %s failed to resolve %s: %s", l.Resolver, l.Host, l.Error))
+		case config.ResolverThreshold > 0 && l.LatencyMs > config.ResolverThreshold:
+			alerts = append(alerts, fmt.Sprintf("DNS resolver %s took %.2f ms to resolve %s, higher than %v ms", l.Resolver, l.LatencyMs, l.Host, config.ResolverThreshold))
+		}
+		if config.ResolverChanges && l.Changed {
+			alerts = append(alerts, fmt.Sprintf("DNS resolver %s answer for %s changed from %s to %s", l.Resolver, l.Host, strings.Join(l.Previous, " "), strings.Join(l.Addresses, " ")))
+		}
+	}
+	return alerts
+}
+
+// TestNow runs a test, storing its result and raising its alerts
+func (m *monitor) TestNow() speedtest.Result {
+	m.mu.Lock()
+	m.testing = true
+	m.mu.Unlock()
+
+	result := m.tester.TestNow()
+	m.results.Add(result)
+	config, _ := m.current()
+	alerts := alertsFor(result, config)
+
+	m.mu.Lock()
+	m.testing = false
+	m.alerts = alerts
+	m.mu.Unlock()
+	m.raise(result.Timestamp, alerts)
+	return result
+}
+
+// probeNow probes the DNS resolvers, storing the probe and raising its
+// alerts
+func (m *monitor) probeNow() {
+	probe := m.prober.Run()
+	m.probes.Add(probe)
+	config, _ := m.current()
+	alerts := resolverAlertsFor(probe, config)
+
+	m.mu.Lock()
+	m.resolverAlerts = alerts
+	m.mu.Unlock()
+	m.raise(probe.Timestamp, alerts)
+}
+
+// raise adds the alerts to the alert log, and sends them through Slack if
+// configured
+func (m *monitor) raise(at time.Time, alerts []string) {
+	m.mu.Lock()
+	for _, alert := range alerts {
+		m.alertLog = append(m.alertLog, handlers.Alert{Time: at, Message: alert})
+	}
+	if len(m.alertLog) > alertLogSize {
+		m.alertLog = m.alertLog[len(m.alertLog)-alertLogSize:]
+	}
+	sc := m.sc
+	m.mu.Unlock()
+
+	if sc != nil && len(alerts) > 0 {
+		for _, alert := range alerts {
+			sc.AddAlert(alert)
+		}
+		go sc.SendMessages()
+	}
+}
+
+// Status returns the state of the periodic tests
+func (m *monitor) Status() handlers.Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return handlers.Status{
+		AppName:           m.config.AppName,
+		IntervalSeconds:   m.config.Interval,
+		NextTest:          m.nextTest,
+		Testing:           m.testing,
+		Alerts:            append([]string{}, m.alerts...),
+		DownloadThreshold: m.config.DownloadThreshold,
+		UploadThreshold:   m.config.UploadThreshold,
+		LatencyThreshold:  m.config.LatencyThreshold,
+		ResolverAlerts:    append([]string{}, m.resolverAlerts...),
+		ResolverThreshold: m.config.ResolverThreshold,
+	}
+}
+
+// Alerts returns the latest alerts raised, oldest first
+func (m *monitor) Alerts() []handlers.Alert {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]handlers.Alert{}, m.alertLog...)
+}
+
+func (m *monitor) startPoller() {
+	m.TestNow()
+	go func() {
+		for {
+			config, _ := m.current()
+			interval := config.Interval
+			pollPeriod := time.Second * time.Duration(interval)
+			log.Debugf("Waiting %d seconds before next poll.", interval)
+			m.mu.Lock()
+			m.nextTest = time.Now().Add(pollPeriod).Round(time.Second)
+			m.mu.Unlock()
+
+			select {
+			case <-time.After(pollPeriod):
+				go m.TestNow()
+			case <-m.reset:
+				log.Debug("Poll interval changed")
+			}
+		}
+	}()
+}
+
+// startProber probes the DNS resolvers periodically, while there are
+// resolvers and hosts to probe
+func (m *monitor) startProber() {
+	go func() {
+		for {
+			if m.prober.Enabled() {
+				m.probeNow()
+			}
+			config, _ := m.current()
+			select {
+			case <-time.After(time.Second * time.Duration(config.ResolverInterval)):
+			case <-m.probeReset:
+				log.Debug("DNS resolver probes changed")
+			}
+		}
+	}()
+}
+
+// watchConfiguration reloads the configuration when its file changes, or
+// when the process receives a SIGHUP
+func (m *monitor) watchConfiguration() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	config, _ := m.current()
+	path := config.Path()
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	if path != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			// Watch the directory, as editors usually replace the file
+			err = watcher.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			log.Errorf("Cannot watch config file %s, send a SIGHUP to reload it: %s", path, err)
+		} else {
+			log.Infof("Watching config file %s", path)
+			events, watchErrors = watcher.Events, watcher.Errors
+		}
+	}
+
+	go func() {
+		var changed <-chan time.Time
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading the configuration")
+				m.reload()
+			case event := <-events:
+				if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					changed = time.After(reloadDelay)
+				}
+			case <-changed:
+				log.Infof("Config file %s changed, reloading the configuration", path)
+				m.reload()
+			case err := <-watchErrors:
+				log.Errorf("Error while watching config file: %s", err)
+			}
+		}
+	}()
+}
+
+// reload reads the configuration again and applies it. An invalid
+// configuration is rejected, keeping the current one.
+func (m *monitor) reload() {
+	conf, err := readConfiguration()
+	if err != nil {
+		log.Errorf("Rejected the new configuration, keeping the current one: %s", err)
+		m.notify(fmt.Sprintf("Rejected the new configuration, keeping the current one: %s", err), true)
+		return
+	}
+	m.apply(conf)
+	log.Info("Configuration reloaded")
+	m.notify(fmt.Sprintf("Configuration of %s reloaded", conf.AppName), false)
+}
+
+// apply replaces the configuration, updating the tester, history, Slack
+// client and poll interval
+func (m *monitor) apply(conf *configuration.Configuration) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	m.replace(conf)
+}
+
+// replace does the work of apply, with applyMu held
+func (m *monitor) replace(conf *configuration.Configuration) {
+	m.mu.Lock()
+	old := m.config
+	m.config = conf
+	if conf.SlackEndpoint != old.SlackEndpoint || conf.AppName != old.AppName {
+		m.sc = nil
+		if conf.SlackEndpoint != "" {
+			m.sc = slack.NewSlackClient(conf)
+		}
+	}
+	m.mu.Unlock()
+
+	setLogLevel(conf)
+	registerBackends(conf)
+	m.results.Resize(conf.HistorySize)
+	if conf.HistoryFile != old.HistoryFile {
+		openHistory(m.results, conf)
+	}
+	m.probes.Resize(conf.HistorySize)
+	if conf.ResolverFile != old.ResolverFile {
+		openProbes(m.probes, conf)
+	}
+	if !reflect.DeepEqual(conf.Resolvers, old.Resolvers) || !reflect.DeepEqual(conf.ResolverHosts, old.ResolverHosts) || conf.ResolverInterval != old.ResolverInterval {
+		m.prober.SetTargets(conf.Resolvers, conf.ResolverHosts)
+		select {
+		case m.probeReset <- struct{}{}:
+		default:
+		}
+	}
+	m.tester.SetAggregate(conf.Aggregate)
+	m.tester.SetValidator(newValidator(conf), m.results)
+
+	// The servers are fetched again when the location or backend change,
+	// keeping the current ones if that fails
+	serversChanged := !reflect.DeepEqual(conf.Latitude, old.Latitude) || !reflect.DeepEqual(conf.Longitude, old.Longitude) || conf.City != old.City ||
+		conf.Backend != old.Backend || !reflect.DeepEqual(conf.SpeedtestServers, old.SpeedtestServers) || conf.LibreSpeedServers != old.LibreSpeedServers ||
+		!reflect.DeepEqual(conf.Iperf3Servers, old.Iperf3Servers) || conf.HTTPDownloadURL != old.HTTPDownloadURL
+	if serversChanged {
+		user := m.user
+		setLocation(&user, conf)
+		list, err := speedtest.FetchServers(conf.Backend, user)
+		if err != nil {
+			log.Errorf("Cannot change the servers, keeping the current ones: %s", err)
+			serversChanged = false
+		} else {
+			m.list = list
+			m.tester.SetClient(list.ReportedClient(user))
+			m.tester.SetFallbacks(nearest(m.list.Servers, 5))
+		}
+	}
+	if serversChanged || !reflect.DeepEqual(conf.Servers, old.Servers) || conf.Strategy != old.Strategy ||
+		conf.SampleSize != old.SampleSize || conf.SecondaryEvery != old.SecondaryEvery {
+		targets := m.list.FindServer(conf.Servers)
+		sampler, err := newSampler(conf, &targets)
+		if err != nil {
+			log.Errorf("Cannot change the server selection: %s", err)
+		} else {
+			m.tester.SetSampler(sampler)
+		}
+	}
+
+	if conf.Interval != old.Interval {
+		select {
+		case m.reset <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/speedtest-monitor/app/speedtest"
+)
+
+// TestConcurrentApply reloads the configuration while it's patched, every
+// change fetching the servers again. Run with -race.
+func TestConcurrentApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "configuration.yaml")
+	file := "backend: http\nhttpDownloadUrl: http://127.0.0.1:1/download\nhttpUploadUrl: http://127.0.0.1:1/upload\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	*configOpt = path
+	conf, err := readConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerBackends(conf)
+	list, err := speedtest.FetchServers(conf.Backend, speedtest.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := list.FindServer(conf.Servers)
+	sampler, err := newSampler(conf, &targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMonitor(conf, speedtest.User{}, list, speedtest.NewTester(speedtest.User{}, sampler, conf.Aggregate))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			m.reload()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			patch := fmt.Sprintf(`{"httpDownloadUrl": "http://127.0.0.%d:1/download", "servers": [1]}`, i+2)
+			patched, keys, err := m.Config().Patch([]byte(patch))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := m.UpdateConfig(patched, keys); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	if m.list.Servers[0].URL != m.Config().HTTPDownloadURL {
+		t.Errorf("servers of %s with the configuration of %s", m.list.Servers[0].URL, m.Config().HTTPDownloadURL)
+	}
+}
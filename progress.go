@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/speedtest-monitor/app/speedtest"
+	"golang.org/x/term"
+)
+
+// Settings of the progress view
+const (
+	frameInterval = 100 * time.Millisecond
+	gaugeWidth    = 20
+	// gaugeMaxMbps : throughput of a full gauge, which has a logarithmic scale
+	gaugeMaxMbps = 10000
+)
+
+var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// progressView shows the progress of the running tests. On a terminal it
+// redraws a status line with a spinner and a throughput gauge; otherwise it
+// logs a line when each phase starts.
+type progressView struct {
+	mu      sync.Mutex
+	out     io.Writer
+	latest  speedtest.Progress
+	started bool
+	frame   int
+	drawn   bool
+}
+
+// isInteractive tells if both the standard output and error are terminals
+func isInteractive() bool {
+	return term.IsTerminal(int(os.Stdout.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// startProgress shows the progress of the tests until the returned
+// function is called
+func startProgress() (stop func()) {
+	if !isInteractive() {
+		var last string
+		speedtest.SetProgressHook(func(p speedtest.Progress) {
+			if p.Phase == last || p.Phase == speedtest.PhaseDone {
+				last = p.Phase
+				return
+			}
+			last = p.Phase
+			log.Infof("[%d/%d] Testing %s of server [%s]", p.Position, p.Total, p.Phase, p.Server.ID)
+		})
+		return func() { speedtest.SetProgressHook(nil) }
+	}
+
+	view := &progressView{out: os.Stderr}
+	// Logs are written through the view, so they don't mix with the status line
+	log.SetOutput(view)
+	speedtest.SetProgressHook(view.update)
+
+	stopped, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(frameInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				view.draw()
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		<-done
+		speedtest.SetProgressHook(nil)
+		view.clear()
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// update stores the latest progress, drawn on the next frame
+func (v *progressView) update(p speedtest.Progress) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.latest = p
+	v.started = true
+}
+
+// Write writes a log line above the status line
+func (v *progressView) Write(p []byte) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.erase()
+	return v.out.Write(p)
+}
+
+// draw redraws the status line with the latest progress
+func (v *progressView) draw() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.started {
+		return
+	}
+	v.frame = (v.frame + 1) % len(spinner)
+	p := v.latest
+
+	line := fmt.Sprintf("%s [%d/%d] %s", spinner[v.frame], p.Position, p.Total, serverName(p.Server))
+	switch p.Phase {
+	case speedtest.PhaseDownload, speedtest.PhaseUpload:
+		line += fmt.Sprintf("  %-8s %s %8.2f Mbit/s", p.Phase, gauge(p.Mbps()), p.Mbps())
+	case speedtest.PhasePing:
+		line += "  ping"
+	default:
+		line += "  done"
+	}
+	if width, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 0 && len([]rune(line)) >= width {
+		line = string([]rune(line)[:width-1])
+	}
+	v.erase()
+	fmt.Fprint(v.out, line)
+	v.drawn = true
+}
+
+// clear erases the status line
+func (v *progressView) clear() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.erase()
+}
+
+func (v *progressView) erase() {
+	if v.drawn {
+		fmt.Fprint(v.out, "\r\x1b[K")
+		v.drawn = false
+	}
+}
+
+// serverName returns the ID, sponsor and name of a server
+func serverName(s speedtest.Server) string {
+	return fmt.Sprintf("[%s] %s (%s)", s.ID, s.Sponsor, s.Name)
+}
+
+// gauge draws the throughput in a bar with a logarithmic scale, from 1
+// Mbit/s to gaugeMaxMbps
+func gauge(mbps float64) string {
+	filled := 0
+	if mbps > 1 {
+		filled = int(math.Round(math.Log10(mbps) / math.Log10(gaugeMaxMbps) * gaugeWidth))
+	}
+	if filled > gaugeWidth {
+		filled = gaugeWidth
+	}
+	return "▕" + strings.Repeat("█", filled) + strings.Repeat("░", gaugeWidth-filled) + "▏"
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/speedtest-monitor/app/server/handlers"
+	"github.com/speedtest-monitor/app/speedtest"
+	"golang.org/x/term"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Settings of the watch dashboard
+const (
+	apiTimeout  = 10 * time.Second
+	testTimeout = 10 * time.Minute
+)
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// dashboard renders the state of a running instance, fetched through its
+// API, on the whole terminal
+type dashboard struct {
+	url     string
+	client  http.Client
+	refresh time.Duration
+
+	mu       sync.Mutex
+	status   handlers.Status
+	results  []speedtest.Result
+	err      error
+	fetched  time.Time
+	testing  bool
+	message  string
+	keys     chan byte
+	redraw   chan struct{}
+	finished chan struct{}
+}
+
+// watch shows the dashboard of the instance at url until q is pressed
+func watch(url string, refresh time.Duration) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		kingpin.Fatalf("watch needs a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	kingpin.FatalIfError(err, "")
+	// Logs would break the screen, the errors are shown in the dashboard
+	log.SetOutput(ioutil.Discard)
+
+	d := &dashboard{
+		url:      strings.TrimRight(url, "/"),
+		client:   http.Client{Timeout: apiTimeout},
+		refresh:  refresh,
+		keys:     make(chan byte),
+		redraw:   make(chan struct{}, 1),
+		finished: make(chan struct{}),
+	}
+	// Use the alternate screen, without cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+		log.SetOutput(os.Stderr)
+	}()
+	d.run()
+}
+
+func (d *dashboard) run() {
+	go d.readKeys()
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+
+	d.fetch()
+	d.draw()
+	fetchTicker := time.NewTicker(d.refresh)
+	defer fetchTicker.Stop()
+	clockTicker := time.NewTicker(time.Second)
+	defer clockTicker.Stop()
+	for {
+		select {
+		case key := <-d.keys:
+			switch key {
+			case 'q', 'Q', 3: // 3 is Ctrl+C, as the terminal is in raw mode
+				return
+			case 'r', 'R':
+				d.fetch()
+			case 't', 'T':
+				d.testNow()
+			}
+		case <-fetchTicker.C:
+			d.fetch()
+		case <-d.finished:
+			return
+		case <-d.redraw:
+		case <-resized:
+		case <-clockTicker.C:
+		}
+		d.draw()
+	}
+}
+
+// readKeys sends the keys pressed to the keys channel
+func (d *dashboard) readKeys() {
+	buffer := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(buffer); err != nil {
+			close(d.finished)
+			return
+		}
+		d.keys <- buffer[0]
+	}
+}
+
+// get decodes the JSON response of an API endpoint
+func (d *dashboard) get(path string, v interface{}) error {
+	resp, err := d.client.Get(d.url + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetch updates the status and results of the instance
+func (d *dashboard) fetch() {
+	var status handlers.Status
+	var results []speedtest.Result
+	err := d.get("/api/v1/status", &status)
+	if err == nil {
+		err = d.get("/api/v1/results", &results)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+	if err == nil {
+		d.status, d.results, d.fetched = status, results, time.Now()
+	}
+}
+
+// testNow triggers a test in the background, fetching the results when it
+// completes
+func (d *dashboard) testNow() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.testing {
+		return
+	}
+	d.testing, d.message = true, "Test requested"
+	go func() {
+		client := http.Client{Timeout: testTimeout}
+		resp, err := client.Post(d.url+"/api/v1/tests", "application/json", bytes.NewReader(nil))
+		message := "Test completed"
+		if err != nil {
+			message = "Test failed: " + err.Error()
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				message = "Test failed: " + resp.Status
+			}
+		}
+		d.fetch()
+		d.mu.Lock()
+		d.testing, d.message = false, message
+		d.mu.Unlock()
+		select {
+		case d.redraw <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// draw renders the whole dashboard
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 40 {
+		width = 80
+	}
+	lines := []string{}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	title := d.status.AppName
+	if title == "" {
+		title = "speedtest-monitor"
+	}
+	add("\x1b[1m %s\x1b[0m  %s", title, d.url)
+	add("")
+
+	if d.err != nil {
+		add(" \x1b[31mCannot reach the instance: %s\x1b[0m", d.err)
+		if !d.fetched.IsZero() {
+			add(" Showing the data of %s", d.fetched.Format("15:04:05"))
+		}
+		add("")
+	}
+
+	if len(d.results) == 0 {
+		add(" No results yet")
+	} else {
+		latest := d.results[len(d.results)-1]
+		add("\x1b[1m Latest result\x1b[0m  %s  %s", latest.Timestamp.Local().Format("2006-01-02 15:04:05"), quality(latest))
+		add("   Download %10.2f Mbit/s    Upload %10.2f Mbit/s", latest.DownloadMbps(), latest.UploadMbps())
+		add("   Ping     %10.2f ms        Jitter %10.2f ms", latest.PingMs, latest.JitterMs)
+		if latest.Error != "" {
+			add("   \x1b[31m%s\x1b[0m", latest.Error)
+		}
+		add("")
+
+		sparkWidth := width - 40
+		if sparkWidth < 10 {
+			sparkWidth = 10
+		}
+		shown := len(d.results)
+		if shown > sparkWidth {
+			shown = sparkWidth
+		}
+		add("\x1b[1m History\x1b[0m  last %d results", shown)
+		d.addSparkline(add, "Download", "Mbit/s", sparkWidth, func(r speedtest.Result) float64 { return r.DownloadMbps() })
+		d.addSparkline(add, "Upload", "Mbit/s", sparkWidth, func(r speedtest.Result) float64 { return r.UploadMbps() })
+		d.addSparkline(add, "Ping", "ms", sparkWidth, func(r speedtest.Result) float64 { return r.PingMs })
+	}
+	add("")
+
+	add("\x1b[1m Alerts\x1b[0m")
+	if len(d.status.Alerts) == 0 {
+		add("   \x1b[32mNone\x1b[0m")
+	}
+	for _, alert := range d.status.Alerts {
+		add("   \x1b[31m! %s\x1b[0m", alert)
+	}
+	add("")
+
+	switch {
+	case d.status.Testing || d.testing:
+		add(" Testing now...")
+	case !d.status.NextTest.IsZero():
+		add(" Next test in %s, at %s", time.Until(d.status.NextTest).Round(time.Second), d.status.NextTest.Local().Format("15:04:05"))
+	}
+	if d.message != "" {
+		add(" %s", d.message)
+	}
+	add("")
+	add("\x1b[2m [t] test now  [r] refresh  [q] quit\x1b[0m")
+
+	// Keep the last line empty, so the screen doesn't scroll
+	if height > 1 && len(lines) >= height {
+		lines = lines[:height-1]
+	}
+	// Overwrite the previous frame instead of clearing the screen, which
+	// would flicker
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Print(b.String())
+}
+
+// addSparkline adds a line with the sparkline of a measurement of the
+// latest results, and its range
+func (d *dashboard) addSparkline(add func(string, ...interface{}), label, unit string, width int, value func(speedtest.Result) float64) {
+	results := d.results
+	if len(results) > width {
+		results = results[len(results)-width:]
+	}
+	values := []float64{}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, r := range results {
+		if r.Quality == speedtest.QualityFailed {
+			values = append(values, math.NaN())
+			continue
+		}
+		v := value(r)
+		values = append(values, v)
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	if math.IsInf(lo, 0) {
+		lo, hi = 0, 0
+	}
+	add("   %-8s %s  %.2f - %.2f %s", label, sparkline(values, lo, hi), lo, hi, unit)
+}
+
+// sparkline draws the values between lo and hi, with a blank for the
+// missing ones
+func sparkline(values []float64, lo, hi float64) string {
+	var b strings.Builder
+	for _, v := range values {
+		if math.IsNaN(v) {
+			b.WriteRune(' ')
+			continue
+		}
+		i := len(sparks) - 1
+		if hi > lo {
+			i = int((v - lo) / (hi - lo) * float64(len(sparks)-1))
+		}
+		b.WriteRune(sparks[i])
+	}
+	return b.String()
+}
+
+// quality returns the colored quality of a result
+func quality(r speedtest.Result) string {
+	switch r.Quality {
+	case speedtest.QualityOK:
+		return "\x1b[32mok\x1b[0m"
+	case speedtest.QualitySuspect:
+		return "\x1b[33msuspect\x1b[0m"
+	case speedtest.QualityFailed:
+		return "\x1b[31mfailed\x1b[0m"
+	default:
+		return r.Quality
+	}
+}